@@ -0,0 +1,132 @@
+package ova
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/masahiro331/go-vmdk-parser/pkg/virtualization/vmdk"
+	"golang.org/x/xerrors"
+)
+
+// File is a regular file in an OVA archive.
+type File struct {
+	// Name is the slash-separated path of the file in the archive, without a
+	// leading "./" or "/".
+	Name string
+	// Offset is the byte offset of the content of the file in the archive.
+	Offset int64
+	Size   int64
+}
+
+// Archive is an OVA archive, a tar file holding an OVF descriptor and the
+// disks of a virtual machine. Its files are read in place from the archive,
+// without extracting them.
+type Archive struct {
+	Files []File
+
+	r io.ReaderAt
+}
+
+// NewArchive lists the regular files of the OVA archive r of size bytes. The
+// content of the files is skipped, not read.
+func NewArchive(r io.ReaderAt, size int64) (*Archive, error) {
+	sr := io.NewSectionReader(r, 0, size)
+	// tar.Reader skips the content of the files by seeking sr.
+	tr := tar.NewReader(sr)
+	a := &Archive{r: r}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read tar header: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		offset, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to get offset of %s: %w", hdr.Name, err)
+		}
+		if offset+hdr.Size > size {
+			return nil, xerrors.Errorf("%s is truncated: %w", hdr.Name, io.ErrUnexpectedEOF)
+		}
+		a.Files = append(a.Files, File{
+			Name:   cleanName(hdr.Name),
+			Offset: offset,
+			Size:   hdr.Size,
+		})
+	}
+	return a, nil
+}
+
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Disks returns the VMDK files of the archive that can be opened with Open,
+// in archive order. Raw extent files of flat disks are left out.
+func (a *Archive) Disks() []File {
+	var disks []File
+	for _, f := range a.Files {
+		if !strings.EqualFold(path.Ext(f.Name), ".vmdk") {
+			continue
+		}
+		if _, err := vmdk.ReadDiskDescriptor(a.Section(f)); err == nil {
+			disks = append(disks, f)
+		}
+	}
+	return disks
+}
+
+// OVF returns the OVF descriptor of the archive.
+func (a *Archive) OVF() (File, bool) {
+	for _, f := range a.Files {
+		if strings.EqualFold(path.Ext(f.Name), ".ovf") {
+			return f, true
+		}
+	}
+	return File{}, false
+}
+
+// Section returns a reader of the content of f.
+func (a *Archive) Section(f File) *io.SectionReader {
+	return io.NewSectionReader(a.r, f.Offset, f.Size)
+}
+
+func (a *Archive) lookup(name string) (File, error) {
+	name = cleanName(name)
+	for _, f := range a.Files {
+		if f.Name == name {
+			return f, nil
+		}
+	}
+	return File{}, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// Open opens the disk of the VMDK file name of the archive with vmdk.Open.
+// Extent and parent files referenced by its descriptor are opened from the
+// archive, relative to the directory of name.
+func (a *Archive) Open(name string, cache vmdk.Cache[vmdk.CacheKey, []byte], opts ...vmdk.Option) (*vmdk.Disk, error) {
+	f, err := a.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	dir := path.Dir(f.Name)
+	open := func(name string) (io.ReaderAt, error) {
+		f, err := a.lookup(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		return a.Section(f), nil
+	}
+	d, err := vmdk.OpenWithOpener(a.Section(f), open, cache, opts...)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open %s: %w", f.Name, err)
+	}
+	return d, nil
+}
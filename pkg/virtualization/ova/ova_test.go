@@ -0,0 +1,116 @@
+package ova_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/masahiro331/go-vmdk-parser/pkg/virtualization/ova"
+	"github.com/masahiro331/go-vmdk-parser/pkg/virtualization/vmdk"
+)
+
+func streamOptimized(t *testing.T, data []byte, name string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := vmdk.WriteStreamOptimized(&buf, bytes.NewReader(data), int64(len(data)), name); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestArchive(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	disk1 := make([]byte, 4*grain)
+	copy(disk1[grain:], bytes.Repeat([]byte("disk1"), grain/5))
+	disk2 := make([]byte, 2*grain)
+	copy(disk2, bytes.Repeat([]byte("disk2"), grain/5))
+
+	// A split image, whose descriptor references its extent.
+	flat := bytes.Repeat([]byte("flat"), grain/4)
+	descriptor := "# Disk DescriptorFile\nversion=1\nCID=fffffffe\nparentCID=ffffffff\ncreateType=\"monolithicFlat\"\n" +
+		"# Extent description\nRW 128 FLAT \"disk3-flat.vmdk\" 0\n"
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"vm.ovf", []byte("<Envelope/>")},
+		{"./disk1.vmdk", streamOptimized(t, disk1, "disk1.vmdk")},
+		// Long names are stored in PAX headers.
+		{strings.Repeat("d", 120) + "/disk2.vmdk", streamOptimized(t, disk2, "disk2.vmdk")},
+		{"disk3.vmdk", []byte(descriptor)},
+		{"disk3-flat.vmdk", flat},
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755}); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(f.data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := ova.NewArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Files) != len(files) {
+		t.Fatalf("Files = %v, want %d files", a.Files, len(files))
+	}
+	for i, f := range a.Files {
+		got, err := io.ReadAll(a.Section(f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, files[i].data) {
+			t.Errorf("%s content mismatch", f.Name)
+		}
+	}
+	if f, ok := a.OVF(); !ok || f.Name != "vm.ovf" {
+		t.Errorf("OVF() = %v, %v", f, ok)
+	}
+
+	var names []string
+	for _, f := range a.Disks() {
+		names = append(names, f.Name)
+	}
+	want := []string{"disk1.vmdk", strings.Repeat("d", 120) + "/disk2.vmdk", "disk3.vmdk"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("Disks() = %v, want %v", names, want)
+	}
+
+	for name, data := range map[string][]byte{
+		"disk1.vmdk": disk1,
+		want[1]:      disk2,
+		"disk3.vmdk": flat,
+	} {
+		d, err := a.Open(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s content mismatch", name)
+		}
+	}
+
+	if _, err := a.Open("missing.vmdk", nil); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open() error = %v, want %v", err, fs.ErrNotExist)
+	}
+}
@@ -1,18 +1,37 @@
 package vmdk
 
+import (
+	"container/list"
+	"sync"
+)
+
 var (
-	_ Cache[string, []byte] = &mockCache[string, []byte]{}
+	_ Cache[CacheKey, []byte]     = &mockCache[CacheKey, []byte]{}
+	_ Cache[CacheKey, []byte]     = &LRUCache{}
+	_ Cache[CacheKey, GrainTable] = &GrainTableCache{}
 )
 
-type Cache[K string, V any] interface {
-	// Add cache data
+// CacheKey identifies a grain or a grain table cached for an image.
+type CacheKey struct {
+	// Namespace identifies the image, so that images can share a cache.
+	// See WithNamespace.
+	Namespace string
+	// Offset is the sector of the grain or the grain table in the image file.
+	Offset int64
+}
+
+// Cache caches decompressed grains and grain tables. Images read concurrently
+// call it from several goroutines, so implementations must be safe for
+// concurrent use. Cached grains must not be modified.
+type Cache[K comparable, V any] interface {
+	// Add cache data, and reports whether an entry was evicted
 	Add(key K, value V) bool
 
 	// Get returns key's value from the cache
 	Get(key K) (value V, ok bool)
 }
 
-type mockCache[K string, V []byte] struct{}
+type mockCache[K comparable, V any] struct{}
 
 func (c *mockCache[K, V]) Add(_ K, _ V) bool {
 	return false
@@ -21,3 +40,134 @@ func (c *mockCache[K, V]) Add(_ K, _ V) bool {
 func (c *mockCache[K, V]) Get(_ K) (v V, evicted bool) {
 	return
 }
+
+// CacheStats reports the effectiveness of a cache.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// LRUCache is a Cache of grains that holds up to a budget of bytes, evicting
+// the least recently used ones. It is safe for concurrent use.
+type LRUCache struct {
+	*lru[[]byte]
+}
+
+// NewLRUCache returns an LRUCache holding up to maxBytes bytes of grains.
+func NewLRUCache(maxBytes int64) *LRUCache {
+	return &LRUCache{newLRU(maxBytes, func(v []byte) int64 { return int64(len(v)) })}
+}
+
+// GrainTableCache is a Cache of grain tables that holds up to a budget of
+// bytes, evicting the least recently used ones. It is safe for concurrent use.
+type GrainTableCache struct {
+	*lru[GrainTable]
+}
+
+// NewGrainTableCache returns a GrainTableCache holding up to maxBytes bytes of
+// grain table entries, which are 2 KiB per table by default.
+func NewGrainTableCache(maxBytes int64) *GrainTableCache {
+	return &GrainTableCache{newLRU(maxBytes, func(gt GrainTable) int64 { return int64(len(gt.Entries)) * 4 })}
+}
+
+// lru is a least recently used cache whose capacity is the total size of
+// the values given by sizeOf.
+type lru[V any] struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	sizeOf   func(V) int64
+	ll       *list.List
+	items    map[CacheKey]*list.Element
+	stats    CacheStats
+}
+
+type lruEntry[V any] struct {
+	key   CacheKey
+	value V
+}
+
+func newLRU[V any](maxBytes int64, sizeOf func(V) int64) *lru[V] {
+	return &lru[V]{
+		maxBytes: maxBytes,
+		sizeOf:   sizeOf,
+		ll:       list.New(),
+		items:    make(map[CacheKey]*list.Element),
+	}
+}
+
+// Add adds value to the cache, and reports whether any entry was evicted.
+// Values larger than the whole budget are not cached.
+func (c *lru[V]) Add(key CacheKey, value V) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.size -= c.sizeOf(e.Value.(*lruEntry[V]).value)
+		c.ll.Remove(e)
+		delete(c.items, key)
+	}
+	size := c.sizeOf(value)
+	if size > c.maxBytes {
+		return false
+	}
+
+	c.items[key] = c.ll.PushFront(&lruEntry[V]{key: key, value: value})
+	c.size += size
+
+	evicted := false
+	for c.size > c.maxBytes {
+		c.removeOldest()
+		evicted = true
+	}
+	return evicted
+}
+
+// Get returns the value of key and marks it as recently used.
+func (c *lru[V]) Get(key CacheKey) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		var zero V
+		return zero, false
+	}
+	c.stats.Hits++
+	c.ll.MoveToFront(e)
+	return e.Value.(*lruEntry[V]).value, true
+}
+
+// Len returns the number of cached entries.
+func (c *lru[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Size returns the total bytes of cached values.
+func (c *lru[V]) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Stats returns the number of hits, misses and evictions so far.
+func (c *lru[V]) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *lru[V]) removeOldest() {
+	e := c.ll.Back()
+	if e == nil {
+		return
+	}
+	entry := c.ll.Remove(e).(*lruEntry[V])
+	delete(c.items, entry.key)
+	c.size -= c.sizeOf(entry.value)
+	c.stats.Evictions++
+}
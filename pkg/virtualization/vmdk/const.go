@@ -1,16 +1,18 @@
 package vmdk
 
 const (
-	// MARKER_EOS    = uint32(0x00000000)
-	MARKER_GT = uint32(0x00000001)
-	MARKER_GD = uint32(0x00000002)
-	// MARKER_FOOTER = uint32(0x00000003)
-	MARKER_GRAIN = uint32(0xffffffff)
+	MARKER_EOS    = uint32(0x00000000)
+	MARKER_GT     = uint32(0x00000001)
+	MARKER_GD     = uint32(0x00000002)
+	MARKER_FOOTER = uint32(0x00000003)
+	MARKER_GRAIN  = uint32(0xffffffff)
 
 	// COWD = uint32(0x434f5744)
 	KDMV = uint32(0x564d444b)
 
 	// Sparse extent header flags
+	FlagValidNewLineDetection    = uint32(0x00000001)
+	FlagUseRedundantGrainTable   = uint32(0x00000002)
 	FlagUseZeroedGrainTableEntry = uint32(0x00000004)
 
 	// Incompatible flags (upper 16 bits)
@@ -21,16 +23,36 @@ const (
 	incompatFlagsMask  = uint32(0xFFFF0000)
 )
 
+const (
+	// GDAtEnd is the GdOffset of a streamOptimized header whose grain directory
+	// is located by the footer.
+	GDAtEnd = int64(-1)
+
+	// CompressionDeflate is the only compression algorithm of compressed grains.
+	CompressionDeflate = int16(1)
+
+	// Grain size and grain table size used when writing images.
+	defaultGrainSize    = int64(128)
+	defaultNumGTEsPerGT = int32(512)
+
+	// defaultGrainTableCacheSize holds 2048 grain tables of 512 entries,
+	// which cover 64 GiB of disk with 64 KiB grains.
+	defaultGrainTableCacheSize = int64(4 << 20)
+)
+
 const (
 	// GTE special values
 	GTEEmpty  = Entry(0) // Sparse: no data allocated
 	GTEZeroed = Entry(1) // Zeroed grain (only when FlagUseZeroedGrainTableEntry is set)
 )
 
+// NoParentCID is the parentCID of a disk that is not a delta disk.
+const NoParentCID = "ffffffff"
+
 const (
 	SPARSE = "SPARSE"
-	// FLAT
-	// ZERO
+	FLAT   = "FLAT"
+	ZERO   = "ZERO"
 	// VMFS
 	// VMFSSPARSE
 	// VMFSRDM
@@ -38,12 +60,12 @@ const (
 )
 
 const (
-	StreamOptimized  = "streamOptimized"
-	MonolithicSparse = "monolithicSparse"
+	StreamOptimized      = "streamOptimized"
+	MonolithicSparse     = "monolithicSparse"
+	MonolithicFlat       = "monolithicFlat"
+	TwoGbMaxExtentSparse = "twoGbMaxExtentSparse"
+	TwoGbMaxExtentFlat   = "twoGbMaxExtentFlat"
 	// Custom
-	// MonolithicFlat
-	// TwoGbMaxExtentSparse
-	// TwoGbMaxExtentFlat
 	// FullDevice
 	// PartitionedDevice
 	// VmfsPreallocated
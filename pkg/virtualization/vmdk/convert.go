@@ -0,0 +1,84 @@
+package vmdk
+
+import (
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+// ConvertToStreamOptimized writes d to w as a streamOptimized image. Only the
+// allocated grains of d are read and compressed. name is the extent file name
+// recorded in the descriptor, which keeps the disk data base of d. progress,
+// if not nil, is called as the conversion proceeds.
+func ConvertToStreamOptimized(d *Disk, w io.Writer, name string, progress ProgressFunc) error {
+	sw, err := newStreamOptimizedWriter(w, d.Size(), name, d.ddb)
+	if err != nil {
+		return err
+	}
+	if err := copyAllocatedGrains(d, sw.header.GrainSize*Sector, progress, sw.writeGrain); err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+// ConvertToMonolithicSparse writes d to w as a monolithicSparse image. Only
+// the allocated grains of d are read, and decompressed if d is compressed.
+// name is the extent file name recorded in the descriptor, which keeps the
+// disk data base of d. progress, if not nil, is called as the conversion
+// proceeds.
+func ConvertToMonolithicSparse(d *Disk, w io.WriterAt, name string, progress ProgressFunc) error {
+	mw, err := newMonolithicSparseWriter(w, d.Size(), name, d.ddb)
+	if err != nil {
+		return err
+	}
+	if err := copyAllocatedGrains(d, mw.header.GrainSize*Sector, progress, mw.writeGrain); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+// copyAllocatedGrains calls write in increasing order for the grains of grain
+// bytes that overlap allocated ranges of d. The grain beyond the end of d is
+// padded with zeros.
+func copyAllocatedGrains(d *Disk, grain int64, progress ProgressFunc, write func(index int64, data []byte) error) error {
+	total := d.Size()
+	var done int64
+	report := func(pos int64) {
+		if pos > total {
+			pos = total
+		}
+		if progress != nil && pos > done {
+			done = pos
+			progress(done, total)
+		}
+	}
+
+	buf := make([]byte, grain)
+	next := int64(0)
+	return d.WalkRanges(func(r Range) error {
+		if r.State == RangeAllocated {
+			first := r.Offset / grain
+			if first < next {
+				// The first grain is shared with the previous range.
+				first = next
+			}
+			last := (r.Offset + r.Length - 1) / grain
+			for index := first; index <= last; index++ {
+				n, err := d.ReadAt(buf, index*grain)
+				if err != nil && err != io.EOF {
+					return xerrors.Errorf("failed to read grain %d: %w", index, err)
+				}
+				for i := n; i < len(buf); i++ {
+					buf[i] = 0
+				}
+				if err := write(index, buf); err != nil {
+					return err
+				}
+				next = index + 1
+				report(next * grain)
+			}
+		}
+		report(r.Offset + r.Length)
+		return nil
+	})
+}
@@ -0,0 +1,167 @@
+package vmdk
+
+import (
+	"io"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// SeekData seeks to the next allocated range at or after the offset.
+	// It has the value of SEEK_DATA on Linux.
+	SeekData = 3
+	// SeekHole seeks to the next unallocated or zeroed range at or after the
+	// offset, or to the end of the disk. It has the value of SEEK_HOLE on Linux.
+	SeekHole = 4
+)
+
+// ErrNoData is returned when seeking at or beyond the end of the disk, or
+// seeking data after the last allocated range, like ENXIO of lseek.
+var ErrNoData = xerrors.New("no data at or after offset")
+
+// errStopWalk stops a walk of ranges early.
+var errStopWalk = xerrors.New("stop walk")
+
+// Disk is an opened virtual disk. Besides reading it as an io.SectionReader,
+// it tells which ranges of the disk hold data.
+type Disk struct {
+	*io.SectionReader
+
+	img sectionReaderInterface
+	// files are the extent and parent files opened for the disk.
+	files *openedFiles
+	// ddb is the disk data base of the descriptor of the disk, which the
+	// converters carry over to the new image.
+	ddb DiskDataBase
+}
+
+func newDisk(img sectionReaderInterface) *Disk {
+	return &Disk{
+		SectionReader: io.NewSectionReader(img, io.SeekStart, img.Size()),
+		img:           img,
+	}
+}
+
+// Close closes the extent and parent files opened by the ExtentOpener, if they
+// implement io.Closer. The file given to Open is left open for the caller.
+func (d *Disk) Close() error {
+	if d.files == nil {
+		return nil
+	}
+	return d.files.close()
+}
+
+// openedFiles records the files opened by an ExtentOpener.
+type openedFiles struct {
+	mu      sync.Mutex
+	closers []io.Closer
+}
+
+// wrap returns an ExtentOpener that records the files opened by open.
+func (f *openedFiles) wrap(open ExtentOpener) ExtentOpener {
+	if open == nil {
+		return nil
+	}
+	return func(name string) (io.ReaderAt, error) {
+		ra, err := open(name)
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := ra.(io.Closer); ok {
+			f.mu.Lock()
+			f.closers = append(f.closers, c)
+			f.mu.Unlock()
+		}
+		return ra, nil
+	}
+}
+
+// close closes the recorded files and returns the first error.
+func (f *openedFiles) close() error {
+	f.mu.Lock()
+	closers := f.closers
+	f.closers = nil
+	f.mu.Unlock()
+
+	var err error
+	for _, c := range closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = xerrors.Errorf("failed to close extent file: %w", cerr)
+		}
+	}
+	return err
+}
+
+// WalkRanges calls fn for the ranges of the disk in order, from offset 0 to
+// Size. Adjacent ranges have different states, and unallocated ranges of a
+// delta disk have the state of its parent. If fn returns an error, the walk
+// stops and WalkRanges returns it.
+func (d *Disk) WalkRanges(fn func(Range) error) error {
+	m := &rangeMerger{fn: fn}
+	if err := walkRanges(d.img, 0, d.img.Size(), m.add); err != nil {
+		return err
+	}
+	return m.flush()
+}
+
+// SeekData returns the offset of the first allocated byte at or after off.
+// Zeroed ranges are holes, as they are not stored either.
+func (d *Disk) SeekData(off int64) (int64, error) {
+	return d.seekRange(off, func(s RangeState) bool { return s == RangeAllocated })
+}
+
+// SeekHole returns the offset of the first unallocated or zeroed byte at or
+// after off. The end of the disk is regarded as a hole.
+func (d *Disk) SeekHole(off int64) (int64, error) {
+	pos, err := d.seekRange(off, func(s RangeState) bool { return s != RangeAllocated })
+	if err == ErrNoData && off < d.Size() {
+		return d.Size(), nil
+	}
+	return pos, err
+}
+
+// seekRange returns the offset of the first byte at or after off in a range
+// whose state matches.
+func (d *Disk) seekRange(off int64, match func(RangeState) bool) (int64, error) {
+	if off < 0 {
+		return 0, xerrors.Errorf("invalid offset: %d", off)
+	}
+	if off >= d.Size() {
+		return 0, ErrNoData
+	}
+
+	pos := int64(-1)
+	err := walkRanges(d.img, off, d.Size()-off, func(r Range) error {
+		if r.Length > 0 && match(r.State) {
+			pos = r.Offset
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil && err != errStopWalk {
+		return 0, err
+	}
+	if pos < 0 {
+		return 0, ErrNoData
+	}
+	return pos, nil
+}
+
+// Seek is like io.SectionReader.Seek, but also accepts SeekData and SeekHole
+// as whence, seeking from offset relative to the start.
+func (d *Disk) Seek(offset int64, whence int) (int64, error) {
+	var err error
+	switch whence {
+	case SeekData:
+		offset, err = d.SeekData(offset)
+	case SeekHole:
+		offset, err = d.SeekHole(offset)
+	default:
+		return d.SectionReader.Seek(offset, whence)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return d.SectionReader.Seek(offset, io.SeekStart)
+}
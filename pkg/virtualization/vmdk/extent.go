@@ -0,0 +1,219 @@
+package vmdk
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	_ sectionReaderInterface = &MultiExtentImage{}
+)
+
+// ExtentOpener opens the extent file referenced by ExtentDescription.Name.
+type ExtentOpener func(name string) (io.ReaderAt, error)
+
+// DirOpener returns an ExtentOpener that opens extent files in dir. Names
+// come from descriptors, so they are kept inside dir: absolute names, such as
+// the parentFileNameHint of hosted disks, are looked up by their base name in
+// dir, and names leaving dir are rejected. The opened files are closed by
+// Disk.Close.
+func DirOpener(dir string) ExtentOpener {
+	return func(name string) (io.ReaderAt, error) {
+		local, ok := localExtentPath(name)
+		if !ok {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+		}
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(local)))
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+}
+
+// localExtentPath returns the slash-separated path of the extent file name
+// relative to the directory of the descriptor. ok is false if the path leaves
+// the directory.
+func localExtentPath(name string) (string, bool) {
+	p := strings.ReplaceAll(name, `\`, "/")
+	if path.IsAbs(p) || (len(p) >= 2 && p[1] == ':') {
+		// An absolute path of the host that created the disk, such as
+		// /vmfs/volumes/datastore/vm/parent.vmdk or C:\VMs\parent.vmdk.
+		p = path.Base(p)
+	}
+	p = path.Clean(p)
+	if p == "." || p == ".." || p == "/" || strings.HasPrefix(p, "../") {
+		return "", false
+	}
+	return p, true
+}
+
+// FSOpener returns an ExtentOpener that opens extent files from fsys.
+// Files returned by fsys must implement io.ReaderAt.
+func FSOpener(fsys fs.FS) ExtentOpener {
+	return func(name string) (io.ReaderAt, error) {
+		f, err := fsys.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		ra, ok := f.(io.ReaderAt)
+		if !ok {
+			f.Close()
+			return nil, xerrors.Errorf("%s: file does not implement io.ReaderAt", name)
+		}
+		return ra, nil
+	}
+}
+
+// MapOpener returns an ExtentOpener that serves extent files from memory.
+func MapOpener(files map[string][]byte) ExtentOpener {
+	return func(name string) (io.ReaderAt, error) {
+		b, ok := files[name]
+		if !ok {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		return bytes.NewReader(b), nil
+	}
+}
+
+type extent struct {
+	// start is the logical byte offset of the extent in the virtual disk.
+	start int64
+	r     sectionReaderInterface
+}
+
+// MultiExtentImage concatenates the extents of a split image
+// (e.g. image-s001.vmdk, image-s002.vmdk, ...) into a single virtual disk.
+type MultiExtentImage struct {
+	VMDK
+
+	extents []extent
+}
+
+func NewMultiExtentImage(v VMDK, open ExtentOpener) (*MultiExtentImage, error) {
+	if open == nil {
+		return nil, ErrNoExtentOpener
+	}
+
+	var start int64
+	var extents []extent
+	for i, ed := range v.DiskDescriptor.Extents {
+		r, err := openExtent(v, start, ed, open)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to open extent[%d] %q: %w", i, ed.Name, err)
+		}
+		extents = append(extents, extent{start: start, r: r})
+		start += r.Size()
+	}
+
+	return &MultiExtentImage{
+		VMDK:    v,
+		extents: extents,
+	}, nil
+}
+
+// openExtent opens a single extent as a reader of ExtentDescription.Size sectors.
+// start is the logical byte offset of the extent in v.
+func openExtent(v VMDK, start int64, ed ExtentDescription, open ExtentOpener) (sectionReaderInterface, error) {
+	switch ed.Type {
+	case SPARSE, FLAT:
+	case ZERO:
+		return NewZeroImage(VMDK{DiskDescriptor: DiskDescriptor{Extents: []ExtentDescription{ed}}})
+	default:
+		return nil, xerrors.Errorf("%s: %w", ed.Type, ErrUnSupportedType)
+	}
+
+	ra, err := open(ed.Name)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open extent file: %w", err)
+	}
+	size, err := readerAtSize(ra)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get extent file size: %w", err)
+	}
+	ev := VMDK{
+		DiskDescriptor: DiskDescriptor{Extents: []ExtentDescription{ed}},
+		cache:          v.cache,
+		r:              ra,
+		size:           size,
+		opts:           v.opts,
+	}
+	ev.opts.namespace = childNamespace(ev.opts.namespace, ed.Name)
+	if v.parent != nil {
+		ev.parent = newParentSection(v.parent, start, ed.Size*Sector)
+	}
+
+	if ed.Type == FLAT {
+		r, err := NewFlatImage(ev)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to new flat image: %w", err)
+		}
+		return r, nil
+	}
+	return newSparseExtent(ev)
+}
+
+// newSparseExtent parses the sparse extent header of v.r and selects
+// the grain reader according to whether grains are compressed.
+func newSparseExtent(v VMDK) (sectionReaderInterface, error) {
+	var err error
+	v.Header, err = ParseHeader(io.NewSectionReader(v.r, 0, v.size))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse header: %w", err)
+	}
+
+	if uint32(v.Header.Flag)&FlagCompressed != 0 {
+		r, err := NewStreamOptimizedImage(v)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to new stream-optimized image: %w", err)
+		}
+		return r, nil
+	}
+	r, err := NewMonolithicSparseImage(v)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to new monolithic-sparse image: %w", err)
+	}
+	return r, nil
+}
+
+func (v *MultiExtentImage) ReadAt(p []byte, off int64) (int, error) {
+	totalSize := v.Size()
+	if off >= totalSize {
+		return 0, io.EOF
+	}
+
+	totalRead := 0
+	for totalRead < len(p) {
+		currentOff := off + int64(totalRead)
+		if currentOff >= totalSize {
+			return totalRead, io.EOF
+		}
+
+		i := sort.Search(len(v.extents), func(i int) bool {
+			return v.extents[i].start+v.extents[i].r.Size() > currentOff
+		})
+		if i == len(v.extents) {
+			return totalRead, io.EOF
+		}
+		e := v.extents[i]
+
+		need := int64(len(p) - totalRead)
+		if end := e.start + e.r.Size(); currentOff+need > end {
+			need = end - currentOff
+		}
+		n, err := e.r.ReadAt(p[totalRead:totalRead+int(need)], currentOff-e.start)
+		totalRead += n
+		if err != nil && (err != io.EOF || int64(n) != need) {
+			return totalRead, xerrors.Errorf("failed to read extent[%d]: %w", i, err)
+		}
+	}
+	return totalRead, nil
+}
@@ -0,0 +1,55 @@
+package vmdk
+
+import (
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	_ sectionReaderInterface = &FlatImage{}
+)
+
+// FlatImage reads a FLAT extent, which stores the disk data uncompressed
+// starting at ExtentDescription.Offset.
+type FlatImage struct {
+	VMDK
+
+	offset int64
+}
+
+func NewFlatImage(v VMDK) (*FlatImage, error) {
+	if len(v.DiskDescriptor.Extents) != 1 {
+		return nil, xerrors.Errorf("invalid number of flat extents: %d", len(v.DiskDescriptor.Extents))
+	}
+	offset := v.DiskDescriptor.Extents[0].Offset
+	if offset < 0 {
+		return nil, xerrors.Errorf("invalid flat extent offset: %d", offset)
+	}
+
+	return &FlatImage{
+		VMDK:   v,
+		offset: offset * Sector,
+	}, nil
+}
+
+func (v *FlatImage) ReadAt(p []byte, off int64) (int, error) {
+	totalSize := v.Size()
+	if off >= totalSize {
+		return 0, io.EOF
+	}
+	var err error
+	if int64(len(p)) > totalSize-off {
+		p = p[:totalSize-off]
+		err = io.EOF
+	}
+
+	n, rerr := v.r.ReadAt(p, v.offset+off)
+	if n < len(p) {
+		if rerr == nil || rerr == io.EOF {
+			rerr = io.ErrUnexpectedEOF
+		}
+		return n, xerrors.Errorf("failed to read flat extent data: %w", rerr)
+	}
+	return n, err
+}
@@ -3,55 +3,101 @@ package vmdk
 import (
 	"encoding/binary"
 	"io"
+	"strings"
+	"sync"
 
 	"golang.org/x/xerrors"
 )
 
 var (
 	_ sectionReaderInterface = &MonolithicSparseImage{}
+	_ io.WriterAt            = &MonolithicSparseImage{}
+
+	ErrReadOnly = xerrors.New("image is read-only")
+	// ErrGrainDirectoryMismatch is returned by OpenWritable when the grain
+	// directory and the redundant one disagree. RepairGrainDirectory fixes it.
+	ErrGrainDirectoryMismatch = xerrors.New("grain directory and redundant grain directory disagree")
 )
 
+// WritableFile is the file of an image opened by OpenWritable, such as *os.File.
+type WritableFile interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
 type MonolithicSparseImage struct {
 	VMDK
 
-	GD      GrainDirectory
-	GTCache map[int64]GrainTable
+	GD GrainDirectory
+
+	// RGD is the redundant grain directory. It is loaded by OpenWritable, and
+	// for reads unless WithRedundantFallback(false) is given.
+	RGD GrainDirectory
+	// fallback is whether reads fall back on RGD.
+	fallback bool
+
+	// mu guards GD, RGD, size and the entries of the cached grain tables.
+	// Grain tables are loaded with mu held, so that a table loaded before a
+	// write is never cached after it.
+	mu sync.RWMutex
+
+	// grainMu is held shared while a grain read from the file is added to
+	// the cache, and exclusively while a grain is written, so that a grain
+	// read before a write is never cached after it.
+	grainMu sync.RWMutex
+
+	// w is nil unless the image is opened by OpenWritable.
+	w io.WriterAt
+	// wmu serializes WriteAt and Close, and guards next and dirty.
+	wmu sync.Mutex
+	// next is the sector at which new grain tables and grains are allocated.
+	next  int64
+	dirty bool
 }
 
 func NewMonolithicSparseImage(v VMDK) (*MonolithicSparseImage, error) {
-	gd, err := parseGrainDirectoryDirect(v.rs, v.Header)
+	if v.opts.gtCache == nil {
+		v.opts = newOptions(nil)
+	}
+	img := &MonolithicSparseImage{VMDK: v}
+	if !v.opts.noRedundantFallback && v.hasRedundantGrainDirectory() {
+		// The redundant grain directory is only needed if the primary one
+		// is damaged, so failing to read it is not an error.
+		if rgd, err := parseGrainDirectoryDirect(v.r, v.Header, v.Header.RgdOffset); err == nil {
+			img.RGD = rgd
+			img.fallback = true
+		}
+	}
+
+	gd, err := parseGrainDirectoryDirect(v.r, v.Header, v.Header.GdOffset)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to parse grain directory: %w", err)
+		if !img.fallback {
+			return nil, xerrors.Errorf("failed to parse grain directory: %w", err)
+		}
+		gd = GrainDirectory{Entries: append([]Entry(nil), img.RGD.Entries...)}
 	}
+	img.GD = gd
+	return img, nil
+}
 
-	return &MonolithicSparseImage{
-		VMDK:    v,
-		GD:      gd,
-		GTCache: make(map[int64]GrainTable),
-	}, nil
+func (v VMDK) hasRedundantGrainDirectory() bool {
+	return v.Header.RgdOffset > 0 && uint32(v.Header.Flag)&FlagUseRedundantGrainTable != 0
 }
 
-// parseGrainDirectoryDirect reads GD entries directly from the offset
-// specified in the header, without markers.
-func parseGrainDirectoryDirect(rs io.ReadSeeker, header Header) (GrainDirectory, error) {
-	if header.GdOffset <= 0 {
-		return GrainDirectory{}, xerrors.Errorf("invalid GdOffset: %d", header.GdOffset)
+// parseGrainDirectoryDirect reads GD entries directly from gdOffset, which is
+// either GdOffset or RgdOffset of the header, without markers.
+func parseGrainDirectoryDirect(r io.ReaderAt, header Header, gdOffset int64) (GrainDirectory, error) {
+	if gdOffset <= 0 {
+		return GrainDirectory{}, xerrors.Errorf("invalid grain directory offset: %d", gdOffset)
 	}
 	numGDEntries, err := numGrainDirectoryEntries(header)
 	if err != nil {
 		return GrainDirectory{}, err
 	}
 
-	offset := header.GdOffset * Sector
-	off, err := rs.Seek(offset, io.SeekStart)
-	if err != nil {
-		return GrainDirectory{}, xerrors.Errorf("failed to seek to grain directory: %w", err)
-	}
-	if off != offset {
-		return GrainDirectory{}, xerrors.Errorf(ErrSeekOffsetFormat, off, offset)
-	}
 	entries := make([]Entry, numGDEntries)
-	if err := binary.Read(rs, binary.LittleEndian, entries); err != nil {
+	sr := io.NewSectionReader(r, gdOffset*Sector, numGDEntries*4)
+	if err := binary.Read(sr, binary.LittleEndian, entries); err != nil {
 		return GrainDirectory{}, xerrors.Errorf("failed to read grain directory entries: %w", err)
 	}
 
@@ -59,95 +105,205 @@ func parseGrainDirectoryDirect(rs io.ReadSeeker, header Header) (GrainDirectory,
 }
 
 func numGrainDirectoryEntries(header Header) (int64, error) {
-	if header.GrainSize == 0 || header.NumGTEsPerGT == 0 {
-		return 0, xerrors.Errorf("invalid header: GrainSize=%d NumGTEsPerGT=%d", header.GrainSize, header.NumGTEsPerGT)
+	if header.GrainSize <= 0 || header.NumGTEsPerGT <= 0 || header.Capacity < 0 {
+		return 0, xerrors.Errorf("invalid header: Capacity=%d GrainSize=%d NumGTEsPerGT=%d",
+			header.Capacity, header.GrainSize, header.NumGTEsPerGT)
+	}
+	// Round up without overflowing on a huge capacity.
+	numGrains := header.Capacity / header.GrainSize
+	if header.Capacity%header.GrainSize != 0 {
+		numGrains++
+	}
+	numGTs := numGrains / int64(header.NumGTEsPerGT)
+	if numGrains%int64(header.NumGTEsPerGT) != 0 {
+		numGTs++
 	}
-	numGrains := (header.Capacity + header.GrainSize - 1) / header.GrainSize
-	return (numGrains + int64(header.NumGTEsPerGT) - 1) / int64(header.NumGTEsPerGT), nil
+	return numGTs, nil
 }
 
 // parseGrainTableDirect reads GT entries directly from the offset, without markers.
 func (v *MonolithicSparseImage) parseGrainTableDirect(gtOffset int64) (GrainTable, error) {
-	offset := gtOffset * Sector
-	off, err := v.rs.Seek(offset, io.SeekStart)
-	if err != nil {
-		return GrainTable{}, xerrors.Errorf("failed to seek to grain table: %w", err)
-	}
-	if off != offset {
-		return GrainTable{}, xerrors.Errorf(ErrSeekOffsetFormat, off, offset)
-	}
-
 	entries := make([]Entry, v.Header.NumGTEsPerGT)
-	if err := binary.Read(v.rs, binary.LittleEndian, entries); err != nil {
+	sr := io.NewSectionReader(v.r, gtOffset*Sector, int64(len(entries))*4)
+	if err := binary.Read(sr, binary.LittleEndian, entries); err != nil {
 		return GrainTable{}, xerrors.Errorf("failed to read grain table entries: %w", err)
 	}
 
 	return GrainTable{Entries: entries}, nil
 }
 
+// grainTable returns the grain table at gtOffset, loading it into the grain
+// table cache. The entries of the returned table must be accessed with mu held.
+func (v *MonolithicSparseImage) grainTable(gtOffset int64) (GrainTable, error) {
+	if gt, ok := v.opts.gtCache.Get(v.cacheKey(gtOffset)); ok {
+		return gt, nil
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.loadGrainTable(gtOffset)
+}
+
+// lockedGrainTable is like grainTable, but must be called with mu held.
+func (v *MonolithicSparseImage) lockedGrainTable(gtOffset int64) (GrainTable, error) {
+	if gt, ok := v.opts.gtCache.Get(v.cacheKey(gtOffset)); ok {
+		return gt, nil
+	}
+	return v.loadGrainTable(gtOffset)
+}
+
+// loadGrainTable parses the grain table at gtOffset into the grain table
+// cache. It must be called with mu held.
+func (v *MonolithicSparseImage) loadGrainTable(gtOffset int64) (GrainTable, error) {
+	gt, err := v.parseGrainTableDirect(gtOffset)
+	if err != nil {
+		return GrainTable{}, xerrors.Errorf("failed to parse grain table entries: %w", err)
+	}
+	v.opts.gtCache.Add(v.cacheKey(gtOffset), gt)
+	return gt, nil
+}
+
 func (v *MonolithicSparseImage) TranslateOffset(off int64) (int64, int64, error) {
 	grain := v.Header.GrainSize * Sector
 	gtSize := grain * int64(v.Header.NumGTEsPerGT)
 
-	gtIndex := off / gtSize
-	if gtIndex >= int64(len(v.GD.Entries)) {
-		return 0, 0, ErrDataNotPresent
+	grainOffset, err := v.grainTableEntry(off/gtSize, off%gtSize/grain)
+	if err != nil {
+		return 0, 0, err
+	}
+	if isGTEAbsent(grainOffset, uint32(v.Header.Flag)) {
+		return 0, 0, absentGrainErr(grainOffset)
 	}
 
-	gtOffset := int64(v.GD.Entries[gtIndex])
+	dataOffset := off % gtSize % grain
+	return int64(grainOffset), dataOffset, nil
+}
+
+// grainTableEntry returns the entryIndex-th entry of the gtIndex-th grain
+// table. If the grain table cannot be read or the entry points outside the
+// file, the entry of the redundant grain table is returned instead when it is
+// usable.
+func (v *MonolithicSparseImage) grainTableEntry(gtIndex, entryIndex int64) (Entry, error) {
+	e, err := v.lookupEntry(&v.GD, gtIndex, entryIndex)
+	if !v.fallback || (err == nil && v.validGrain(e)) {
+		return e, err
+	}
+	re, rerr := v.lookupEntry(&v.RGD, gtIndex, entryIndex)
+	if rerr != nil || !v.validGrain(re) {
+		return e, err
+	}
+	return re, nil
+}
+
+// lookupEntry returns the entryIndex-th entry of the gtIndex-th grain table
+// of gd. It must be called without mu held.
+func (v *MonolithicSparseImage) lookupEntry(gd *GrainDirectory, gtIndex, entryIndex int64) (Entry, error) {
+	gt, ok, err := v.lookupGrainTable(gd, gtIndex)
+	if err != nil || !ok || entryIndex >= int64(len(gt.Entries)) {
+		return GTEEmpty, err
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return gt.Entries[entryIndex], nil
+}
+
+// lookupEntries returns a copy of the entries of the gtIndex-th grain table of
+// gd, or nil if the grain table is not allocated. It must be called without mu
+// held.
+func (v *MonolithicSparseImage) lookupEntries(gd *GrainDirectory, gtIndex int64) ([]Entry, error) {
+	gt, ok, err := v.lookupGrainTable(gd, gtIndex)
+	if err != nil || !ok {
+		return nil, err
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return append([]Entry(nil), gt.Entries...), nil
+}
+
+// lookupGrainTable returns the gtIndex-th grain table of gd. ok is false if
+// the grain table is not allocated. It must be called without mu held.
+func (v *MonolithicSparseImage) lookupGrainTable(gd *GrainDirectory, gtIndex int64) (gt GrainTable, ok bool, err error) {
+	v.mu.RLock()
+	var gtOffset int64
+	if gtIndex < int64(len(gd.Entries)) {
+		gtOffset = int64(gd.Entries[gtIndex])
+	}
+	size := v.size
+	v.mu.RUnlock()
 	if gtOffset == 0 {
-		return 0, 0, ErrDataNotPresent
+		return GrainTable{}, false, nil
+	}
+	gtSectors := (int64(v.Header.NumGTEsPerGT)*4 + Sector - 1) / Sector
+	if gtOffset < 0 || (gtOffset+gtSectors)*Sector > size {
+		return GrainTable{}, false, xerrors.Errorf("grain table %d at sector %d is out of the file", gtIndex, gtOffset)
 	}
 
-	gt, ok := v.GTCache[gtOffset]
-	if !ok {
-		var err error
-		gt, err = v.parseGrainTableDirect(gtOffset)
-		if err != nil {
-			return 0, 0, xerrors.Errorf("failed to parse grain table entries: %w", err)
-		}
-		v.GTCache[gtOffset] = gt
+	gt, err = v.grainTable(gtOffset)
+	if err != nil {
+		return GrainTable{}, false, err
 	}
+	return gt, true, nil
+}
 
-	entryIndex := off % gtSize / grain
-	if entryIndex >= int64(len(gt.Entries)) {
-		return 0, 0, ErrDataNotPresent
+// grainTableEntries returns the entries of the gtIndex-th grain table, or nil
+// if it is not allocated. Entries are taken from the redundant grain table as
+// in grainTableEntry.
+func (v *MonolithicSparseImage) grainTableEntries(gtIndex int64) ([]Entry, error) {
+	entries, err := v.lookupEntries(&v.GD, gtIndex)
+	if !v.fallback || (err == nil && v.validGrains(entries)) {
+		return entries, err
+	}
+	rentries, rerr := v.lookupEntries(&v.RGD, gtIndex)
+	if rerr != nil {
+		return entries, err
 	}
+	if err != nil {
+		if !v.validGrains(rentries) {
+			return nil, err
+		}
+		return rentries, nil
+	}
+	for i, e := range entries {
+		if !v.validGrain(e) && i < len(rentries) && v.validGrain(rentries[i]) {
+			entries[i] = rentries[i]
+		}
+	}
+	return entries, nil
+}
 
-	grainOffset := gt.Entries[entryIndex]
-	if isGTEAbsent(grainOffset, uint32(v.Header.Flag)) {
-		return 0, 0, ErrDataNotPresent
+func (v *MonolithicSparseImage) validGrains(entries []Entry) bool {
+	for _, e := range entries {
+		if !v.validGrain(e) {
+			return false
+		}
 	}
+	return true
+}
 
-	dataOffset := off % gtSize % grain
-	return int64(grainOffset), dataOffset, nil
+// validGrain reports whether the grain table entry e is absent or points to a
+// grain within the file.
+func (v *MonolithicSparseImage) validGrain(e Entry) bool {
+	if isGTEAbsent(e, uint32(v.Header.Flag)) {
+		return true
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return e > 0 && (int64(e)+v.Header.GrainSize)*Sector <= v.size
 }
 
 func (v *MonolithicSparseImage) read(grainOffset int64) ([]byte, error) {
-	cacheKey := grainOffsetCacheKey(grainOffset)
+	cacheKey := v.cacheKey(grainOffset)
 	data, ok := v.cache.Get(cacheKey)
 	if ok {
 		return data, nil
 	}
 
-	offset := grainOffset * Sector
-	off, err := v.rs.Seek(offset, io.SeekStart)
-	if err != nil {
-		return nil, xerrors.Errorf("failed to seek to grain data: %w", err)
-	}
-	if off != offset {
-		return nil, xerrors.Errorf(ErrSeekOffsetFormat, off, offset)
-	}
-
-	grainDataSize := v.Header.GrainSize * Sector
-	buf := make([]byte, grainDataSize)
-	n, err := io.ReadFull(v.rs, buf)
-	if err != nil {
+	buf := make([]byte, v.grainDataSize())
+	v.grainMu.RLock()
+	defer v.grainMu.RUnlock()
+	if err := readFullAt(v.r, buf, grainOffset*Sector); err != nil {
 		return nil, xerrors.Errorf("failed to read grain data: %w", err)
 	}
-	if int64(n) != grainDataSize {
-		return nil, xerrors.Errorf(ErrReadSizeFormat, n, grainDataSize)
-	}
 
 	v.cache.Add(cacheKey, buf)
 	return buf, nil
@@ -158,5 +314,267 @@ func (v *MonolithicSparseImage) grainDataSize() int64 {
 }
 
 func (v *MonolithicSparseImage) ReadAt(p []byte, off int64) (int, error) {
-	return readAt(v, p, off)
+	return readAt(v, v.parent, p, off)
+}
+
+// OpenWritable opens a monolithicSparse image for reading and writing.
+// Close must be called after writing to clear the unclean shutdown flag.
+func OpenWritable(f WritableFile, cache Cache[CacheKey, []byte], opts ...Option) (*MonolithicSparseImage, error) {
+	var err error
+
+	// If cache is not provided, use mock.
+	if cache == nil {
+		cache = &mockCache[CacheKey, []byte]{}
+	}
+	size, err := readerAtSize(f)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get file size: %w", err)
+	}
+	v := VMDK{r: f, size: size, cache: cache, opts: newOptions(opts)}
+	// Writes go to both grain directories, so they must agree. Damaged images
+	// are fixed with RepairGrainDirectory first.
+	v.opts.noRedundantFallback = true
+	v.Header, err = ParseHeader(io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse header: %w", err)
+	}
+	if uint32(v.Header.Flag)&FlagCompressed != 0 {
+		return nil, xerrors.Errorf("compressed grains: %w", ErrUnSupportedType)
+	}
+	v.DiskDescriptor, err = ParseDiskDescriptor(io.NewSectionReader(f, 0, size), v.Header)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse disk descriptor: %w", err)
+	}
+	if v.DiskDescriptor.CreateType != MonolithicSparse {
+		return nil, xerrors.Errorf("%s: %w", v.DiskDescriptor.CreateType, ErrUnSupportedType)
+	}
+	if dd := v.DiskDescriptor; dd.ParentCID != "" && !strings.EqualFold(dd.ParentCID, NoParentCID) {
+		return nil, xerrors.Errorf("delta disk: %w", ErrUnSupportedType)
+	}
+
+	img, err := NewMonolithicSparseImage(v)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to new monolithic-sparse image: %w", err)
+	}
+	if v.hasRedundantGrainDirectory() {
+		img.RGD, err = parseGrainDirectoryDirect(v.r, v.Header, v.Header.RgdOffset)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to parse redundant grain directory: %w", err)
+		}
+		// A grain table missing from either directory could not be updated
+		// in both.
+		for i, e := range img.GD.Entries {
+			if (e == 0) != (img.RGD.Entries[i] == 0) {
+				return nil, xerrors.Errorf("grain table %d: %w", i, ErrGrainDirectoryMismatch)
+			}
+		}
+	}
+
+	img.next = (size + Sector - 1) / Sector
+	img.w = f
+	return img, nil
+}
+
+// WriteAt writes p at the logical offset off, allocating grain tables and
+// grains at the end of the file as needed. The first write marks the image as
+// uncleanly shut down until Close. It may be called concurrently with ReadAt,
+// while concurrent writes are serialized.
+func (v *MonolithicSparseImage) WriteAt(p []byte, off int64) (int, error) {
+	if v.w == nil {
+		return 0, ErrReadOnly
+	}
+	v.wmu.Lock()
+	defer v.wmu.Unlock()
+
+	if off < 0 {
+		return 0, xerrors.Errorf("invalid offset: %d", off)
+	}
+	var err error
+	if totalSize := v.Size(); int64(len(p)) > totalSize-off {
+		if off >= totalSize {
+			return 0, ErrExceedCapacity
+		}
+		p = p[:totalSize-off]
+		err = ErrExceedCapacity
+	}
+	if !v.dirty {
+		if err := v.writeUncleanShutdown(1); err != nil {
+			return 0, err
+		}
+		v.dirty = true
+	}
+
+	grain := v.grainDataSize()
+	written := 0
+	for written < len(p) {
+		currentOff := off + int64(written)
+		dataOff := currentOff % grain
+		n := grain - dataOff
+		if remaining := int64(len(p) - written); n > remaining {
+			n = remaining
+		}
+		if err := v.writeGrain(currentOff/grain, dataOff, p[written:written+int(n)]); err != nil {
+			return written, xerrors.Errorf("failed to write grain: %w", err)
+		}
+		written += int(n)
+	}
+	return written, err
+}
+
+// writeGrain writes p at dataOff of the grain at index by rewriting the whole grain.
+func (v *MonolithicSparseImage) writeGrain(index, dataOff int64, p []byte) error {
+	grain := v.grainDataSize()
+	grainOffset, _, err := v.TranslateOffset(index * grain)
+	allocated := err == nil
+	if err != nil && err != ErrDataNotPresent && err != ErrDataZeroed {
+		return xerrors.Errorf("failed to translate offset: %w", err)
+	}
+
+	buf := make([]byte, grain)
+	if allocated {
+		data, err := v.read(grainOffset)
+		if err != nil {
+			return xerrors.Errorf("failed to read grain: %w", err)
+		}
+		copy(buf, data)
+	} else if isZero(p) {
+		// Unallocated and zeroed grains already read as zeros.
+		return nil
+	} else {
+		grainOffset = v.next
+		v.next += v.Header.GrainSize
+	}
+	copy(buf[dataOff:], p)
+
+	v.grainMu.Lock()
+	_, err = v.w.WriteAt(buf, grainOffset*Sector)
+	if err == nil {
+		v.cache.Add(v.cacheKey(grainOffset), buf)
+	}
+	v.grainMu.Unlock()
+	if err != nil {
+		return xerrors.Errorf("failed to write grain data: %w", err)
+	}
+	if allocated {
+		return nil
+	}
+	return v.setGrainTableEntry(index, Entry(grainOffset))
+}
+
+// setGrainTableEntry points the grain table entry of grain index to
+// grainOffset in both the grain table and its redundant copy.
+func (v *MonolithicSparseImage) setGrainTableEntry(index int64, grainOffset Entry) error {
+	numGTEsPerGT := int64(v.Header.NumGTEsPerGT)
+	gtIndex := index / numGTEsPerGT
+	if gtIndex >= int64(len(v.GD.Entries)) {
+		return xerrors.Errorf("grain %d is out of the grain directory", index)
+	}
+	// The directories are only modified by writers, which are serialized by
+	// wmu, so they can be read here without mu.
+	if v.GD.Entries[gtIndex] == 0 {
+		if err := v.allocateGrainTable(gtIndex); err != nil {
+			return err
+		}
+	}
+
+	gtOffsets := []Entry{v.GD.Entries[gtIndex]}
+	if len(v.RGD.Entries) > 0 {
+		gtOffsets = append(gtOffsets, v.RGD.Entries[gtIndex])
+	}
+	for _, gtOffset := range gtOffsets {
+		// Entry 0 would be written into the header.
+		if gtOffset <= 0 {
+			return xerrors.Errorf("grain table %d at sector %d: %w", gtIndex, gtOffset, ErrGrainDirectoryMismatch)
+		}
+	}
+	// Hold mu while the file and the cached table differ, so that no reader
+	// loads the table in between.
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.growSize()
+	for _, gtOffset := range gtOffsets {
+		if err := v.writeEntry(int64(gtOffset), index%numGTEsPerGT, grainOffset); err != nil {
+			return xerrors.Errorf("failed to write grain table entry: %w", err)
+		}
+	}
+
+	gt, err := v.lockedGrainTable(int64(gtOffsets[0]))
+	if err != nil {
+		return err
+	}
+	gt.Entries[index%numGTEsPerGT] = grainOffset
+	return nil
+}
+
+// allocateGrainTable allocates an empty grain table, and its redundant copy,
+// at the end of the file and links them from the grain directories.
+func (v *MonolithicSparseImage) allocateGrainTable(gtIndex int64) error {
+	gtSize := (int64(v.Header.NumGTEsPerGT)*4 + Sector - 1) / Sector
+	empty := make([]byte, gtSize*Sector)
+
+	type directory struct {
+		gd     *GrainDirectory
+		offset int64
+	}
+	dirs := []directory{{&v.GD, v.Header.GdOffset}}
+	if len(v.RGD.Entries) > 0 {
+		dirs = append(dirs, directory{&v.RGD, v.Header.RgdOffset})
+	}
+	for _, d := range dirs {
+		gtOffset := v.next
+		v.next += gtSize
+		if _, err := v.w.WriteAt(empty, gtOffset*Sector); err != nil {
+			return xerrors.Errorf("failed to write grain table: %w", err)
+		}
+		if err := v.writeEntry(d.offset, gtIndex, Entry(gtOffset)); err != nil {
+			return xerrors.Errorf("failed to write grain directory entry: %w", err)
+		}
+		v.mu.Lock()
+		v.growSize()
+		d.gd.Entries[gtIndex] = Entry(gtOffset)
+		v.mu.Unlock()
+	}
+	return nil
+}
+
+// growSize extends the file size checked by readers to the sectors allocated
+// so far. It must be called with wmu and mu held.
+func (v *MonolithicSparseImage) growSize() {
+	if size := v.next * Sector; size > v.size {
+		v.size = size
+	}
+}
+
+// writeEntry writes the index-th entry of the table at sector offset.
+func (v *MonolithicSparseImage) writeEntry(offset, index int64, e Entry) error {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(e))
+	_, err := v.w.WriteAt(buf, offset*Sector+index*4)
+	return err
+}
+
+func (v *MonolithicSparseImage) writeUncleanShutdown(b byte) error {
+	v.Header.UncleanShutdown = b
+	if _, err := v.w.WriteAt(encodeHeader(v.Header), 0); err != nil {
+		return xerrors.Errorf("failed to write header: %w", err)
+	}
+	return nil
+}
+
+// Close clears the unclean shutdown flag set by WriteAt. It does not close
+// the underlying file.
+func (v *MonolithicSparseImage) Close() error {
+	if v.w == nil {
+		return nil
+	}
+	v.wmu.Lock()
+	defer v.wmu.Unlock()
+	if !v.dirty {
+		return nil
+	}
+	if err := v.writeUncleanShutdown(0); err != nil {
+		return err
+	}
+	v.dirty = false
+	return nil
 }
@@ -0,0 +1,186 @@
+package vmdk
+
+import (
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+// minDescriptorSize is the number of sectors reserved for the embedded
+// descriptor, leaving room to edit it in place as VMware does.
+const minDescriptorSize = 20
+
+// MonolithicSparseWriter writes a monolithicSparse image to an io.WriterAt.
+// Grains are appended after the metadata as they are written, all-zero grains
+// are left unallocated, and the metadata is written by Close.
+type MonolithicSparseWriter struct {
+	w          io.WriterAt
+	header     Header
+	descriptor []byte
+
+	// gtOffset and rgtOffset are the sectors of the first grain table and
+	// its redundant copy. Grain tables are contiguous.
+	gtOffset  int64
+	rgtOffset int64
+	// gtes holds the entries of all grain tables.
+	gtes []Entry
+	// next is the sector of the next allocated grain.
+	next   int64
+	closed bool
+}
+
+// NewMonolithicSparseWriter returns a writer of a monolithicSparse image of
+// capacity bytes. name is the extent file name recorded in the descriptor.
+func NewMonolithicSparseWriter(w io.WriterAt, capacity int64, name string) (*MonolithicSparseWriter, error) {
+	return newMonolithicSparseWriter(w, capacity, name, DiskDataBase{})
+}
+
+// newMonolithicSparseWriter is like NewMonolithicSparseWriter, but records the entries set in
+// ddb in the descriptor.
+func newMonolithicSparseWriter(w io.WriterAt, capacity int64, name string, ddb DiskDataBase) (*MonolithicSparseWriter, error) {
+	if capacity <= 0 || capacity%Sector != 0 {
+		return nil, xerrors.Errorf("invalid capacity %d: must be a positive multiple of %d", capacity, Sector)
+	}
+	dd, err := newDiskDescriptor(MonolithicSparse, name, capacity/Sector, ddb)
+	if err != nil {
+		return nil, err
+	}
+	descriptor := marshalDiskDescriptor(dd)
+	descriptorSize := (int64(len(descriptor)) + Sector - 1) / Sector
+	if descriptorSize < minDescriptorSize {
+		descriptorSize = minDescriptorSize
+	}
+
+	header := newSparseHeader(capacity/Sector, descriptorSize)
+	header.Flag = int32(FlagValidNewLineDetection | FlagUseRedundantGrainTable)
+	numGTs, err := numGrainDirectoryEntries(header)
+	if err != nil {
+		return nil, err
+	}
+	gdSize := (numGTs*4 + Sector - 1) / Sector
+	gtSize := int64(header.NumGTEsPerGT) * 4 / Sector
+
+	// header, descriptor, RGD, redundant GTs, GD, GTs, then grains.
+	header.RgdOffset = header.DescriptorOffset + header.DescriptorSize
+	rgtOffset := header.RgdOffset + gdSize
+	header.GdOffset = rgtOffset + numGTs*gtSize
+	gtOffset := header.GdOffset + gdSize
+	overHead := gtOffset + numGTs*gtSize
+	header.OverHead = (overHead + header.GrainSize - 1) / header.GrainSize * header.GrainSize
+
+	return &MonolithicSparseWriter{
+		w:          w,
+		header:     header,
+		descriptor: descriptor,
+		gtOffset:   gtOffset,
+		rgtOffset:  rgtOffset,
+		gtes:       make([]Entry, numGTs*int64(header.NumGTEsPerGT)),
+		next:       header.OverHead,
+	}, nil
+}
+
+// WriteMonolithicSparse writes the capacity bytes of disk data of r to w as a
+// monolithicSparse image.
+func WriteMonolithicSparse(w io.WriterAt, r io.ReaderAt, capacity int64, name string) error {
+	mw, err := NewMonolithicSparseWriter(w, capacity, name)
+	if err != nil {
+		return err
+	}
+	if err := mw.CopyFrom(r); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+// CopyFrom writes the grains of the disk data of r. Data beyond the end of r
+// is treated as zeros.
+func (w *MonolithicSparseWriter) CopyFrom(r io.ReaderAt) error {
+	grain := w.header.GrainSize * Sector
+	capacity := w.header.Capacity * Sector
+	buf := make([]byte, grain)
+	for off := int64(0); off < capacity; off += grain {
+		n, err := r.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return xerrors.Errorf("failed to read disk data at %d: %w", off, err)
+		}
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		if err := w.writeGrain(off/grain, buf); err != nil {
+			return err
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return nil
+}
+
+// writeGrain writes the grain at index, allocating it at the end of the image
+// unless it is already allocated. All-zero grains are not allocated.
+func (w *MonolithicSparseWriter) writeGrain(index int64, data []byte) error {
+	if w.closed {
+		return xerrors.New("write to closed writer")
+	}
+	if index < 0 || index >= (w.header.Capacity+w.header.GrainSize-1)/w.header.GrainSize {
+		return xerrors.Errorf("grain %d is out of range", index)
+	}
+
+	offset := int64(w.gtes[index])
+	if offset == 0 {
+		if isZero(data) {
+			return nil
+		}
+		offset = w.next
+		w.next += w.header.GrainSize
+		w.gtes[index] = Entry(offset)
+	}
+	if _, err := w.w.WriteAt(data, offset*Sector); err != nil {
+		return xerrors.Errorf("failed to write grain %d: %w", index, err)
+	}
+	return nil
+}
+
+// Close writes the header, the descriptor, the grain directories and the grain
+// tables. It does not close the underlying writer.
+func (w *MonolithicSparseWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	numGTs := int64(len(w.gtes)) / int64(w.header.NumGTEsPerGT)
+	gtSize := int64(w.header.NumGTEsPerGT) * 4 / Sector
+	gd := make([]Entry, numGTs)
+	rgd := make([]Entry, numGTs)
+	for i := range gd {
+		gd[i] = Entry(w.gtOffset + int64(i)*gtSize)
+		rgd[i] = Entry(w.rgtOffset + int64(i)*gtSize)
+	}
+
+	// Extend an image without grains to OverHead.
+	if w.next == w.header.OverHead {
+		if _, err := w.w.WriteAt(make([]byte, Sector), (w.header.OverHead-1)*Sector); err != nil {
+			return xerrors.Errorf("failed to write padding: %w", err)
+		}
+	}
+
+	writes := []struct {
+		name   string
+		data   []byte
+		offset int64
+	}{
+		{"header", encodeHeader(w.header), 0},
+		{"descriptor", w.descriptor, w.header.DescriptorOffset},
+		{"redundant grain directory", encodeEntries(rgd), w.header.RgdOffset},
+		{"redundant grain tables", encodeEntries(w.gtes), w.rgtOffset},
+		{"grain directory", encodeEntries(gd), w.header.GdOffset},
+		{"grain tables", encodeEntries(w.gtes), w.gtOffset},
+	}
+	for _, wr := range writes {
+		if _, err := w.w.WriteAt(wr.data, wr.offset*Sector); err != nil {
+			return xerrors.Errorf("failed to write %s: %w", wr.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package vmdk
+
+import (
+	"runtime"
+	"strconv"
+	"sync/atomic"
+)
+
+// namespaceSeq numbers the images opened without WithNamespace.
+var namespaceSeq uint64
+
+// Option configures how an image is opened.
+type Option func(*options)
+
+type options struct {
+	// readAheadWindow is the number of grains prefetched ahead of sequential
+	// reads of streamOptimized extents. Read-ahead is disabled if it is 0.
+	readAheadWindow  int
+	readAheadWorkers int
+
+	gtCache Cache[CacheKey, GrainTable]
+	// namespace is the CacheKey.Namespace of the image. It is a path of
+	// quoted components, the namespace given to Open followed by the file
+	// names of the extents and parents, so that different paths never map to
+	// the same namespace.
+	namespace string
+	// noRedundantFallback disables reading through the redundant grain
+	// directory of monolithicSparse extents.
+	noRedundantFallback bool
+	// streamRecovery enables rebuilding the grain tables of streamOptimized
+	// extents whose footer or grain directory is unusable.
+	streamRecovery bool
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.gtCache == nil {
+		o.gtCache = NewGrainTableCache(defaultGrainTableCacheSize)
+	}
+	if o.namespace == "" {
+		o.namespace = "#" + strconv.FormatUint(atomic.AddUint64(&namespaceSeq, 1), 10)
+	}
+	o.namespace = strconv.Quote(o.namespace)
+	return o
+}
+
+// childNamespace returns the namespace of the extent or parent file name of
+// the image of namespace ns.
+func childNamespace(ns, name string) string {
+	return ns + "/" + strconv.Quote(name)
+}
+
+// WithReadAhead enables read-ahead for streamOptimized extents. When reads are
+// sequential, the grain being read and up to window grains after it are
+// decompressed in advance by workers goroutines. A prefetched grain is kept
+// until the reads move past it, so at most window+1 grains not read yet are
+// held besides the grains being read. workers defaults to GOMAXPROCS if it is
+// not positive.
+func WithReadAhead(window, workers int) Option {
+	return func(o *options) {
+		if window < 0 {
+			window = 0
+		}
+		if workers <= 0 {
+			workers = runtime.GOMAXPROCS(0)
+		}
+		o.readAheadWindow = window
+		o.readAheadWorkers = workers
+	}
+}
+
+// WithGrainTableCache caches the grain tables of the image in c, such as a
+// GrainTableCache whose statistics are of interest. By default, each opened
+// image caches up to 4 MiB of grain tables.
+func WithGrainTableCache(c Cache[CacheKey, GrainTable]) Option {
+	return func(o *options) {
+		o.gtCache = c
+	}
+}
+
+// WithNamespace sets the namespace of the cache keys of the image. By default,
+// every opened image has its own namespace, so that a cache shared between
+// images never mixes them up. Opening the same image again with the same
+// namespace reuses what is cached for it; images with different content must
+// not share a namespace.
+func WithNamespace(namespace string) Option {
+	return func(o *options) {
+		o.namespace = namespace
+	}
+}
+
+// WithRedundantFallback sets whether reads of monolithicSparse extents fall back
+// on the redundant grain directory and grain tables when the primary ones are
+// unreadable or point outside the file. It is enabled by default.
+func WithRedundantFallback(enabled bool) Option {
+	return func(o *options) {
+		o.noRedundantFallback = !enabled
+	}
+}
+
+// WithStreamRecovery sets whether streamOptimized extents whose footer or grain
+// directory is missing or damaged, such as partially downloaded files, are
+// recovered by scanning their markers from the start. The grains found are
+// readable, while the others read as unallocated. It is disabled by default.
+func WithStreamRecovery(enabled bool) Option {
+	return func(o *options) {
+		o.streamRecovery = enabled
+	}
+}
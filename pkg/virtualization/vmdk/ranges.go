@@ -0,0 +1,249 @@
+package vmdk
+
+import (
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+// RangeState is the allocation state of a range of a virtual disk.
+type RangeState int
+
+const (
+	// RangeUnallocated ranges are not stored in any image of the disk and
+	// read as zeros.
+	RangeUnallocated RangeState = iota
+	// RangeAllocated ranges are stored in an image of the disk.
+	RangeAllocated
+	// RangeZeroed ranges are explicitly marked as zeros, by zeroed grain table
+	// entries or ZERO extents. They read as zeros without reading any data.
+	RangeZeroed
+)
+
+func (s RangeState) String() string {
+	switch s {
+	case RangeUnallocated:
+		return "unallocated"
+	case RangeAllocated:
+		return "allocated"
+	case RangeZeroed:
+		return "zeroed"
+	}
+	return "unknown"
+}
+
+// Range is a range of a virtual disk in bytes.
+type Range struct {
+	Offset int64
+	Length int64
+	State  RangeState
+}
+
+// rangeWalker is implemented by images that know which of their ranges
+// are allocated.
+type rangeWalker interface {
+	// walkRanges calls fn for the ranges covering [off, off+n) in order.
+	// Adjacent ranges may have the same state.
+	walkRanges(off, n int64, fn func(Range) error) error
+}
+
+var (
+	_ rangeWalker = &StreamOptimizedImage{}
+	_ rangeWalker = &MonolithicSparseImage{}
+	_ rangeWalker = &FlatImage{}
+	_ rangeWalker = &ZeroImage{}
+	_ rangeWalker = &MultiExtentImage{}
+	_ rangeWalker = &parentSection{}
+)
+
+// walkRanges walks [off, off+n) of r. Readers that do not implement
+// rangeWalker are regarded as allocated up to their size.
+func walkRanges(r io.ReaderAt, off, n int64, fn func(Range) error) error {
+	if n <= 0 {
+		return nil
+	}
+	if s, ok := r.(interface{ Size() int64 }); ok && off+n > s.Size() {
+		// Data beyond the end of a parent reads as zeros.
+		size := s.Size() - off
+		if size < 0 {
+			size = 0
+		}
+		if err := walkRanges(r, off, size, fn); err != nil {
+			return err
+		}
+		return fn(Range{Offset: off + size, Length: n - size, State: RangeUnallocated})
+	}
+	if w, ok := r.(rangeWalker); ok {
+		return w.walkRanges(off, n, fn)
+	}
+	return fn(Range{Offset: off, Length: n, State: RangeAllocated})
+}
+
+// grainTables describes the grain tables of a sparse extent for walkGrains.
+type grainTables struct {
+	// grainSize is the size of a grain in bytes.
+	grainSize    int64
+	numGTEsPerGT int64
+	flags        uint32
+	// entries returns the entries of the gtIndex-th grain table, or nil if the
+	// grain table is not allocated.
+	entries func(gtIndex int64) ([]Entry, error)
+}
+
+// walkGrains walks [off, off+n) of gt grain by grain. The span of an
+// unallocated grain table is walked in one step. Unallocated grains of a
+// delta disk are walked in parent.
+func walkGrains(gt grainTables, parent io.ReaderAt, off, n int64, fn func(Range) error) error {
+	grain := gt.grainSize
+	gtSize := grain * gt.numGTEsPerGT
+	end := off + n
+	emit := func(r Range) error {
+		if r.State == RangeUnallocated && parent != nil {
+			return walkRanges(parent, r.Offset, r.Length, fn)
+		}
+		return fn(r)
+	}
+	for cur := off; cur < end; {
+		gtIndex := cur / gtSize
+		gtEnd := (gtIndex + 1) * gtSize
+		if gtEnd > end {
+			gtEnd = end
+		}
+		entries, err := gt.entries(gtIndex)
+		if err != nil {
+			return xerrors.Errorf("failed to read grain table %d: %w", gtIndex, err)
+		}
+		if entries == nil {
+			if err := emit(Range{Offset: cur, Length: gtEnd - cur, State: RangeUnallocated}); err != nil {
+				return err
+			}
+			cur = gtEnd
+			continue
+		}
+
+		for cur < gtEnd {
+			next := (cur/grain + 1) * grain
+			if next > gtEnd {
+				next = gtEnd
+			}
+
+			r := Range{Offset: cur, Length: next - cur, State: RangeAllocated}
+			entry := GTEEmpty
+			if entryIndex := cur % gtSize / grain; entryIndex < int64(len(entries)) {
+				entry = entries[entryIndex]
+			}
+			if isGTEAbsent(entry, gt.flags) {
+				r.State = RangeUnallocated
+				if entry == GTEZeroed {
+					r.State = RangeZeroed
+				}
+			}
+			if err := emit(r); err != nil {
+				return err
+			}
+			cur = next
+		}
+	}
+	return nil
+}
+
+func (v *StreamOptimizedImage) walkRanges(off, n int64, fn func(Range) error) error {
+	gt := grainTables{
+		grainSize:    v.grainDataSize(),
+		numGTEsPerGT: int64(v.SparseExtentHeader.NumberGTEsPerGT),
+		flags:        v.SparseExtentHeader.Flags,
+		entries:      v.grainTableEntries,
+	}
+	return walkGrains(gt, v.parent, off, n, fn)
+}
+
+func (v *MonolithicSparseImage) walkRanges(off, n int64, fn func(Range) error) error {
+	gt := grainTables{
+		grainSize:    v.grainDataSize(),
+		numGTEsPerGT: int64(v.Header.NumGTEsPerGT),
+		flags:        uint32(v.Header.Flag),
+		entries:      v.grainTableEntries,
+	}
+	return walkGrains(gt, v.parent, off, n, fn)
+}
+
+func (v *FlatImage) walkRanges(off, n int64, fn func(Range) error) error {
+	return fn(Range{Offset: off, Length: n, State: RangeAllocated})
+}
+
+func (v *ZeroImage) walkRanges(off, n int64, fn func(Range) error) error {
+	return fn(Range{Offset: off, Length: n, State: RangeZeroed})
+}
+
+func (v *MultiExtentImage) walkRanges(off, n int64, fn func(Range) error) error {
+	end := off + n
+	for _, e := range v.extents {
+		start, stop := e.start, e.start+e.r.Size()
+		if stop <= off || start >= end {
+			continue
+		}
+		if start < off {
+			start = off
+		}
+		if stop > end {
+			stop = end
+		}
+		err := walkRanges(e.r, start-e.start, stop-start, func(r Range) error {
+			r.Offset += e.start
+			return fn(r)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parentSection is the range of a parent disk backing an extent of a delta disk.
+type parentSection struct {
+	*io.SectionReader
+
+	r   io.ReaderAt
+	off int64
+}
+
+func newParentSection(r io.ReaderAt, off, n int64) *parentSection {
+	return &parentSection{SectionReader: io.NewSectionReader(r, off, n), r: r, off: off}
+}
+
+func (s *parentSection) walkRanges(off, n int64, fn func(Range) error) error {
+	return walkRanges(s.r, s.off+off, n, func(r Range) error {
+		r.Offset -= s.off
+		return fn(r)
+	})
+}
+
+// rangeMerger coalesces adjacent ranges of the same state.
+type rangeMerger struct {
+	fn  func(Range) error
+	cur Range
+}
+
+func (m *rangeMerger) add(r Range) error {
+	if r.Length <= 0 {
+		return nil
+	}
+	if m.cur.Length > 0 && m.cur.State == r.State && m.cur.Offset+m.cur.Length == r.Offset {
+		m.cur.Length += r.Length
+		return nil
+	}
+	if err := m.flush(); err != nil {
+		return err
+	}
+	m.cur = r
+	return nil
+}
+
+func (m *rangeMerger) flush() error {
+	if m.cur.Length <= 0 {
+		return nil
+	}
+	r := m.cur
+	m.cur = Range{}
+	return m.fn(r)
+}
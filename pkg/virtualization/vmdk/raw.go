@@ -0,0 +1,60 @@
+package vmdk
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+// rawChunkSize is the size of the reads and writes of ConvertToRaw.
+const rawChunkSize = 1 << 20
+
+// ProgressFunc is called with the number of bytes of the disk processed so far
+// and the size of the disk.
+type ProgressFunc func(done, total int64)
+
+// ConvertToRaw writes the content of d to f as a raw disk image, replacing the
+// content of f. Unallocated and zeroed ranges, as well as all-zero chunks of
+// allocated ranges, are not written, so they are left as holes if the file
+// system supports sparse files. progress, if not nil, is called as the
+// conversion proceeds.
+func ConvertToRaw(d *Disk, f *os.File, progress ProgressFunc) error {
+	total := d.Size()
+	if err := f.Truncate(0); err != nil {
+		return xerrors.Errorf("failed to truncate file: %w", err)
+	}
+	if err := f.Truncate(total); err != nil {
+		return xerrors.Errorf("failed to extend file: %w", err)
+	}
+
+	buf := make([]byte, rawChunkSize)
+	return d.WalkRanges(func(r Range) error {
+		if r.State != RangeAllocated {
+			if progress != nil {
+				progress(r.Offset+r.Length, total)
+			}
+			return nil
+		}
+
+		for off, end := r.Offset, r.Offset+r.Length; off < end; {
+			chunk := buf
+			if int64(len(chunk)) > end-off {
+				chunk = chunk[:end-off]
+			}
+			if n, err := d.ReadAt(chunk, off); err != nil && (err != io.EOF || n != len(chunk)) {
+				return xerrors.Errorf("failed to read disk at %d: %w", off, err)
+			}
+			if !isZero(chunk) {
+				if _, err := f.WriteAt(chunk, off); err != nil {
+					return xerrors.Errorf("failed to write at %d: %w", off, err)
+				}
+			}
+			off += int64(len(chunk))
+			if progress != nil {
+				progress(off, total)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,141 @@
+package vmdk
+
+import "sync"
+
+// readAhead decompresses the grains following sequential reads of a
+// streamOptimized extent in the background.
+type readAhead struct {
+	img    *StreamOptimizedImage
+	window int64
+	// sem limits the number of grains decompressed at the same time.
+	sem chan struct{}
+	// slots bounds the number of prefetched grains held in memory that are not
+	// taken yet, including dropped ones that are still being decompressed.
+	slots chan struct{}
+
+	mu sync.Mutex
+	// next is the logical grain index expected by a sequential read.
+	next int64
+	// pending holds the prefetched grains keyed by grain offset. A grain is
+	// kept after it is taken, until the reads move past it.
+	pending map[int64]*prefetch
+}
+
+type prefetch struct {
+	// index is the logical grain index.
+	index int64
+	// taken reports whether a read has used the grain and freed its slot.
+	taken bool
+	done  chan struct{}
+	data  []byte
+	err   error
+}
+
+func newReadAhead(img *StreamOptimizedImage, window, workers int) *readAhead {
+	return &readAhead{
+		img:     img,
+		window:  int64(window),
+		sem:     make(chan struct{}, workers),
+		slots:   make(chan struct{}, window+1),
+		pending: make(map[int64]*prefetch),
+	}
+}
+
+// observe records a read of n bytes at off, and prefetches the grain it ends
+// in, which the next read likely continues, and the grains after it if the
+// read continues the previous one.
+func (r *readAhead) observe(off int64, n int) {
+	if n <= 0 {
+		return
+	}
+	grain := r.img.grainDataSize()
+	first := off / grain
+	last := (off + int64(n) - 1) / grain
+
+	r.mu.Lock()
+	sequential := first == r.next || first == r.next-1
+	r.next = last + 1
+	// Drop the grains that will not be read anymore.
+	for grainOffset, p := range r.pending {
+		if !sequential || p.index < first {
+			delete(r.pending, grainOffset)
+			if !p.taken {
+				go r.release(p)
+			}
+		}
+	}
+	r.mu.Unlock()
+	if !sequential {
+		return
+	}
+
+	numGrains := (r.img.Size() + grain - 1) / grain
+	for index := last; index <= last+r.window && index < numGrains; index++ {
+		grainOffset, _, err := r.img.TranslateOffset(index * grain)
+		if err != nil {
+			// Absent grains are not read from the file.
+			continue
+		}
+		if !r.schedule(index, grainOffset) {
+			return
+		}
+	}
+}
+
+// schedule starts decompressing the grain at grainOffset unless it is already
+// pending. It reports false if the window is full.
+func (r *readAhead) schedule(index, grainOffset int64) bool {
+	if _, ok := r.img.cache.Get(r.img.cacheKey(grainOffset)); ok {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.pending[grainOffset]; ok {
+		return true
+	}
+	select {
+	case r.slots <- struct{}{}:
+	default:
+		return false
+	}
+	p := &prefetch{index: index, done: make(chan struct{})}
+	r.pending[grainOffset] = p
+
+	go func() {
+		r.sem <- struct{}{}
+		p.data, p.err = r.img.decompressGrain(grainOffset)
+		<-r.sem
+		close(p.done)
+	}()
+	return true
+}
+
+// take returns the prefetched grain at grainOffset, waiting for it to be
+// decompressed. ok is false if the grain is not prefetched. The grain stays
+// pending for the following reads inside it, and is dropped by observe.
+func (r *readAhead) take(grainOffset int64) (data []byte, ok bool, err error) {
+	r.mu.Lock()
+	p, ok := r.pending[grainOffset]
+	first := ok && !p.taken
+	if first {
+		p.taken = true
+	}
+	r.mu.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+
+	if first {
+		r.release(p)
+	} else {
+		<-p.done
+	}
+	return p.data, true, p.err
+}
+
+// release frees the slot of p once it is decompressed.
+func (r *readAhead) release(p *prefetch) {
+	<-p.done
+	<-r.slots
+}
@@ -0,0 +1,78 @@
+package vmdk
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// newReaderAt returns a positional reader of rs and its size. rs is used as is
+// if it implements io.ReaderAt, otherwise its Seek and Read calls are serialized.
+// The offset of rs is left where it was.
+func newReaderAt(rs io.ReadSeeker) (io.ReaderAt, int64, error) {
+	pos, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, xerrors.Errorf("failed to get offset: %w", err)
+	}
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, xerrors.Errorf("failed to seek to end: %w", err)
+	}
+	if _, err := rs.Seek(pos, io.SeekStart); err != nil {
+		return nil, 0, xerrors.Errorf("failed to restore offset: %w", err)
+	}
+	if ra, ok := rs.(io.ReaderAt); ok {
+		return ra, size, nil
+	}
+	return &seekReaderAt{rs: rs}, size, nil
+}
+
+// seekReaderAt implements io.ReaderAt on top of an io.ReadSeeker.
+type seekReaderAt struct {
+	mu sync.Mutex
+	rs io.ReadSeeker
+}
+
+func (r *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.rs, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func readerAtSize(ra io.ReaderAt) (int64, error) {
+	switch r := ra.(type) {
+	case interface{ Size() int64 }:
+		return r.Size(), nil
+	case interface{ Stat() (os.FileInfo, error) }:
+		fi, err := r.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	case io.Seeker:
+		return r.Seek(0, io.SeekEnd)
+	}
+	return 0, xerrors.Errorf("unknown size of %T", ra)
+}
+
+// readFullAt reads exactly len(buf) bytes of r at off.
+func readFullAt(r io.ReaderAt, buf []byte, off int64) error {
+	n, err := r.ReadAt(buf, off)
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		return xerrors.Errorf(ErrReadSizeFormat, n, len(buf))
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+package vmdk
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+var ErrNoRedundantGrainDirectory = xerrors.New("image has no redundant grain directory")
+
+// RepairGrainDirectory rewrites the grain directory and grain tables of the
+// monolithicSparse image f from their redundant copies wherever they disagree.
+// The redundant copies are trusted, so Verify may be used first to find out
+// which of them is damaged. Grain tables that are outside the file are
+// written at the end of the file. It returns the number of grain tables
+// repaired. The image must not be open while it is repaired.
+func RepairGrainDirectory(f WritableFile) (int, error) {
+	size, err := readerAtSize(f)
+	if err != nil {
+		return 0, xerrors.Errorf("failed to get file size: %w", err)
+	}
+	header, err := ParseHeader(io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return 0, xerrors.Errorf("failed to parse header: %w", err)
+	}
+	if uint32(header.Flag)&FlagCompressed != 0 {
+		return 0, xerrors.Errorf("compressed grains: %w", ErrUnSupportedType)
+	}
+	if !(VMDK{Header: header}).hasRedundantGrainDirectory() {
+		return 0, ErrNoRedundantGrainDirectory
+	}
+
+	rgd, err := parseGrainDirectoryDirect(f, header, header.RgdOffset)
+	if err != nil {
+		return 0, xerrors.Errorf("failed to parse redundant grain directory: %w", err)
+	}
+	numGDEntries := int64(len(rgd.Entries))
+	gdSectors := (numGDEntries*4 + Sector - 1) / Sector
+	if header.GdOffset <= 0 || (header.GdOffset+gdSectors)*Sector > size {
+		return 0, xerrors.Errorf("invalid grain directory offset: %d", header.GdOffset)
+	}
+	gd, err := parseGrainDirectoryDirect(f, header, header.GdOffset)
+	if err != nil {
+		return 0, xerrors.Errorf("failed to parse grain directory: %w", err)
+	}
+
+	gtSectors := (int64(header.NumGTEsPerGT)*4 + Sector - 1) / Sector
+	readTable := func(offset, n int64) ([]Entry, error) {
+		entries := make([]Entry, n)
+		sr := io.NewSectionReader(f, offset*Sector, n*4)
+		if err := binary.Read(sr, binary.LittleEndian, entries); err != nil {
+			return nil, err
+		}
+		return entries, nil
+	}
+
+	// Read the redundant grain tables first, to know which parts of the file
+	// are in use.
+	rgts := make([][]Entry, numGDEntries)
+	used := []usedRange{
+		{start: 0, end: 1},
+		{start: header.DescriptorOffset, end: header.DescriptorOffset + header.DescriptorSize},
+		{start: header.RgdOffset, end: header.RgdOffset + gdSectors},
+		{start: header.GdOffset, end: header.GdOffset + gdSectors},
+	}
+	for i, rgtOffset := range rgd.Entries {
+		if rgtOffset == 0 {
+			continue
+		}
+		rgts[i], err = readTable(int64(rgtOffset), int64(header.NumGTEsPerGT))
+		if err != nil {
+			return 0, xerrors.Errorf("failed to read redundant grain table %d: %w", i, err)
+		}
+		used = append(used, usedRange{start: int64(rgtOffset), end: int64(rgtOffset) + gtSectors})
+		for _, e := range rgts[i] {
+			if !isGTEAbsent(e, uint32(header.Flag)) {
+				used = append(used, usedRange{start: int64(e), end: int64(e) + header.GrainSize})
+			}
+		}
+	}
+	sort.Slice(used, func(i, j int) bool {
+		return used[i].start < used[j].start
+	})
+	// maxEnd[i] is the largest end of used[:i+1].
+	maxEnd := make([]int64, len(used))
+	for i, u := range used {
+		maxEnd[i] = u.end
+		if i > 0 && maxEnd[i-1] > u.end {
+			maxEnd[i] = maxEnd[i-1]
+		}
+	}
+	// inUse reports whether [start, end) overlaps a used range.
+	inUse := func(start, end int64) bool {
+		i := sort.Search(len(used), func(i int) bool {
+			return used[i].start >= end
+		})
+		return i > 0 && maxEnd[i-1] > start
+	}
+
+	// Grain tables that cannot be rewritten in place are relocated after the
+	// end of the file.
+	next := (size + Sector - 1) / Sector
+	repaired := 0
+	gdChanged := false
+	// claimed holds the grain tables already rewritten.
+	claimed := make(map[int64]bool)
+	for i, rgt := range rgts {
+		gtOffset := int64(gd.Entries[i])
+		if rgt == nil {
+			if gtOffset != 0 {
+				gd.Entries[i] = 0
+				gdChanged = true
+				repaired++
+			}
+			continue
+		}
+
+		var gt []Entry
+		if gtOffset > 0 && (gtOffset+gtSectors)*Sector <= size &&
+			!inUse(gtOffset, gtOffset+gtSectors) && !claimed[gtOffset] {
+			gt, err = readTable(gtOffset, int64(header.NumGTEsPerGT))
+			if err != nil {
+				return repaired, xerrors.Errorf("failed to read grain table %d: %w", i, err)
+			}
+		} else {
+			gtOffset = next
+			next += gtSectors
+			gd.Entries[i] = Entry(gtOffset)
+			gdChanged = true
+		}
+		claimed[gtOffset] = true
+		if gt != nil && equalEntries(gt, rgt) {
+			continue
+		}
+		if _, err := f.WriteAt(encodeEntries(rgt), gtOffset*Sector); err != nil {
+			return repaired, xerrors.Errorf("failed to write grain table %d: %w", i, err)
+		}
+		repaired++
+	}
+
+	if gdChanged {
+		if _, err := f.WriteAt(encodeEntries(gd.Entries), header.GdOffset*Sector); err != nil {
+			return repaired, xerrors.Errorf("failed to write grain directory: %w", err)
+		}
+	}
+	return repaired, nil
+}
+
+func equalEntries(a, b []Entry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"compress/zlib"
 	"encoding/binary"
-	"fmt"
 	"io"
 	"unsafe"
 
@@ -28,7 +27,14 @@ type StreamOptimizedImage struct {
 
 	SparseExtentHeader SparseExtentHeader
 	GD                 GrainDirectory
-	GTCache            map[int64]GrainTable
+
+	// recovered holds the grain tables rebuilt by scanning the file, keyed by
+	// grain table index, when it is opened with WithStreamRecovery and its
+	// grain directory is unusable. GD is empty if it is not nil.
+	recovered map[int64]GrainTable
+
+	// readAhead is nil unless enabled by WithReadAhead.
+	readAhead *readAhead
 }
 
 type SparseExtentHeader struct {
@@ -63,17 +69,19 @@ type GrainTable struct {
 
 var (
 	ErrDataNotPresent = xerrors.New("data not present")
+	// ErrDataZeroed is returned for grains explicitly marked as zero. Unlike
+	// unallocated grains, they do not fall through to the parent of a delta disk.
+	ErrDataZeroed = xerrors.Errorf("grain is zeroed: %w", ErrDataNotPresent)
 )
 
-func parseSparseExtentHeader(rs io.ReadSeeker) (SparseExtentHeader, error) {
+func parseSparseExtentHeader(r io.ReaderAt, size int64) (SparseExtentHeader, error) {
 	// Sparse extent header is in the last 1024 bytes.
-	_, err := rs.Seek(-1024, io.SeekEnd)
-	if err != nil {
-		return SparseExtentHeader{}, xerrors.Errorf("failed to seek error: %w", err)
+	if size < 1024 {
+		return SparseExtentHeader{}, xerrors.Errorf("file is too small for a footer: %d bytes", size)
 	}
 
 	h := SparseExtentHeader{}
-	err = binary.Read(rs, binary.LittleEndian, &h)
+	err := binary.Read(io.NewSectionReader(r, size-1024, 1024), binary.LittleEndian, &h)
 	if err != nil {
 		return SparseExtentHeader{}, xerrors.Errorf("failed to read binary error: %w", err)
 	}
@@ -84,28 +92,21 @@ func parseSparseExtentHeader(rs io.ReadSeeker) (SparseExtentHeader, error) {
 	if err := validateIncompatFlags(h.Flags); err != nil {
 		return SparseExtentHeader{}, err
 	}
+	// Both divide every offset translation.
+	if err := validateGrainGeometry(int64(h.GrainSize), int64(h.NumberGTEsPerGT)); err != nil {
+		return SparseExtentHeader{}, xerrors.Errorf("invalid footer: %w", err)
+	}
 
 	return h, nil
 }
 
-func (h SparseExtentHeader) parseGrainDirectoryEntries(rs io.ReadSeeker) (GrainDirectory, error) {
+func (h SparseExtentHeader) parseGrainDirectoryEntries(r io.ReaderAt) (GrainDirectory, error) {
 	offset := int64(h.GdOffset-1) * Sector
-	off, err := rs.Seek(offset, io.SeekStart)
-	if err != nil {
-		return GrainDirectory{}, err
-	}
-	if off != offset {
-		return GrainDirectory{}, xerrors.Errorf(ErrSeekOffsetFormat, off, offset)
-	}
 
 	buf := make([]byte, Sector)
-	n, err := rs.Read(buf)
-	if err != nil {
+	if err := readFullAt(r, buf, offset); err != nil {
 		return GrainDirectory{}, xerrors.Errorf("failed to read grain directory marker: %w", err)
 	}
-	if n != int(Sector) {
-		return GrainDirectory{}, xerrors.Errorf(ErrReadSizeFormat, n, Sector)
-	}
 
 	marker := parseMarker(buf)
 	if marker.Type != MARKER_GD {
@@ -114,15 +115,12 @@ func (h SparseExtentHeader) parseGrainDirectoryEntries(rs io.ReadSeeker) (GrainD
 
 	dataSize := Sector * int64(marker.Value)
 	buf = make([]byte, dataSize)
-	n, err = rs.Read(buf)
-	if err != nil {
+	if err := readFullAt(r, buf, offset+Sector); err != nil {
 		return GrainDirectory{}, xerrors.Errorf("failed to read grain directory: %w", err)
 	}
-	if int64(n) != dataSize {
-		return GrainDirectory{}, xerrors.Errorf(ErrReadSizeFormat, n, dataSize)
-	}
 
 	var gd GrainDirectory
+	var err error
 	gd.Entries, err = parseEntries(buf, marker.Value)
 	if err != nil {
 		return GrainDirectory{}, xerrors.Errorf("failed to parse entries: %w", err)
@@ -135,22 +133,11 @@ func (v *StreamOptimizedImage) parseGrainTableEntries(gdeOffset int64) (GrainTab
 	var gt GrainTable
 
 	offset := (gdeOffset - 1) * Sector
-	off, err := v.rs.Seek(offset, io.SeekStart)
-	if err != nil {
-		return GrainTable{}, xerrors.Errorf("failed to seek to grain table offset: %w", err)
-	}
-	if off != offset {
-		return GrainTable{}, xerrors.Errorf(ErrSeekOffsetFormat, off, offset)
-	}
 
 	buf := make([]byte, Sector)
-	n, err := v.rs.Read(buf)
-	if err != nil {
+	if err := readFullAt(v.r, buf, offset); err != nil {
 		return GrainTable{}, xerrors.Errorf("failed to read grain table marker: %w", err)
 	}
-	if n != int(Sector) {
-		return GrainTable{}, xerrors.Errorf(ErrReadSizeFormat, n, Sector)
-	}
 
 	marker := parseMarker(buf)
 	if marker.Type != MARKER_GT {
@@ -159,12 +146,8 @@ func (v *StreamOptimizedImage) parseGrainTableEntries(gdeOffset int64) (GrainTab
 
 	dataSize := Sector * int64(marker.Value)
 	buf = make([]byte, dataSize)
-	n, err = v.rs.Read(buf)
-	if err != nil {
-		return GrainTable{}, xerrors.Errorf("failed to read grain directory: %w", err)
-	}
-	if int64(n) != dataSize {
-		return GrainTable{}, xerrors.Errorf(ErrReadSizeFormat, n, dataSize)
+	if err := readFullAt(v.r, buf, offset+Sector); err != nil {
+		return GrainTable{}, xerrors.Errorf("failed to read grain table: %w", err)
 	}
 
 	entries, err := parseEntries(buf, marker.Value)
@@ -176,6 +159,22 @@ func (v *StreamOptimizedImage) parseGrainTableEntries(gdeOffset int64) (GrainTab
 	return gt, nil
 }
 
+// grainTable returns the grain table at gtOffset, loading it into the grain
+// table cache. Concurrent misses may parse the same table.
+func (v *StreamOptimizedImage) grainTable(gtOffset int64) (GrainTable, error) {
+	key := v.cacheKey(gtOffset)
+	if gt, ok := v.opts.gtCache.Get(key); ok {
+		return gt, nil
+	}
+
+	gt, err := v.parseGrainTableEntries(gtOffset)
+	if err != nil {
+		return GrainTable{}, xerrors.Errorf("failed to parse grain table entries: %w", err)
+	}
+	v.opts.gtCache.Add(key, gt)
+	return gt, nil
+}
+
 func parseEntries(buf []byte, value uint64) ([]Entry, error) {
 	entrySize := int64(unsafe.Sizeof(Entry(0)))
 	r := bytes.NewReader(buf)
@@ -191,35 +190,64 @@ func parseEntries(buf []byte, value uint64) ([]Entry, error) {
 }
 
 func NewStreamOptimizedImage(v VMDK) (*StreamOptimizedImage, error) {
-	h, err := parseSparseExtentHeader(v.rs)
-	if err != nil {
-		return nil, xerrors.Errorf("failed to parse sparse extent header: %w", err)
+	if v.opts.gtCache == nil {
+		v.opts = newOptions(nil)
+	}
+	img := &StreamOptimizedImage{VMDK: v}
+	if err := img.parseGrainDirectory(); err != nil {
+		if !v.opts.streamRecovery {
+			return nil, err
+		}
+		if rerr := img.recoverGrainTables(); rerr != nil {
+			return nil, xerrors.Errorf("failed to recover (%v): %w", err, rerr)
+		}
 	}
+	if v.opts.readAheadWindow > 0 {
+		img.readAhead = newReadAhead(img, v.opts.readAheadWindow, v.opts.readAheadWorkers)
+	}
+	return img, nil
+}
 
-	gd, err := h.parseGrainDirectoryEntries(v.rs)
+// parseGrainDirectory parses the footer and the grain directory.
+func (v *StreamOptimizedImage) parseGrainDirectory() error {
+	h, err := parseSparseExtentHeader(v.r, v.size)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to parse grain directory: %w", err)
+		return xerrors.Errorf("failed to parse sparse extent header: %w", err)
 	}
 
-	return &StreamOptimizedImage{
-		VMDK:               v,
-		SparseExtentHeader: h,
-		GD:                 gd,
-		GTCache:            make(map[int64]GrainTable),
-	}, nil
-}
+	gd, err := h.parseGrainDirectoryEntries(v.r)
+	if err != nil {
+		return xerrors.Errorf("failed to parse grain directory: %w", err)
+	}
 
-func grainOffsetCacheKey(n int64) string {
-	return fmt.Sprintf("vmdk:%d", n)
+	v.SparseExtentHeader = h
+	v.GD = gd
+	return nil
 }
 
 func (v *StreamOptimizedImage) read(grainOffset int64) ([]byte, error) {
-	cacheKey := grainOffsetCacheKey(grainOffset)
+	cacheKey := v.cacheKey(grainOffset)
 	data, ok := v.cache.Get(cacheKey)
 	if ok {
 		return data, nil
 	}
 
+	var err error
+	if v.readAhead != nil {
+		data, ok, err = v.readAhead.take(grainOffset)
+	}
+	if !ok {
+		data, err = v.decompressGrain(grainOffset)
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.cache.Add(cacheKey, data)
+	return data, nil
+}
+
+// decompressGrain reads and inflates the grain at grainOffset.
+func (v *StreamOptimizedImage) decompressGrain(grainOffset int64) ([]byte, error) {
 	b, err := v.readGrain(grainOffset)
 	if err != nil {
 		return nil, xerrors.Errorf("failed to read grain data: %w", err)
@@ -239,7 +267,6 @@ func (v *StreamOptimizedImage) read(grainOffset int64) ([]byte, error) {
 	if int64(n) != grainDataSize {
 		return nil, xerrors.Errorf(ErrReadSizeFormat, n, grainDataSize)
 	}
-	v.cache.Add(cacheKey, decompressedData)
 	return decompressedData, nil
 }
 
@@ -248,26 +275,17 @@ func (v *StreamOptimizedImage) grainDataSize() int64 {
 }
 
 func (v *StreamOptimizedImage) ReadAt(p []byte, off int64) (int, error) {
-	return readAt(v, p, off)
+	if v.readAhead != nil {
+		v.readAhead.observe(off, len(p))
+	}
+	return readAt(v, v.parent, p, off)
 }
 
 func (v *StreamOptimizedImage) readGrain(grainOffset int64) ([]byte, error) {
-	off, err := v.rs.Seek(grainOffset*Sector, 0)
-	if err != nil {
-		return nil, xerrors.Errorf("failed to seek to grain data offset: %w", err)
-	}
-	if off != grainOffset*Sector {
-		return nil, xerrors.Errorf(ErrSeekOffsetFormat, off, grainOffset*Sector)
-	}
-
 	buf := make([]byte, Sector)
-	n, err := v.rs.Read(buf)
-	if err != nil {
+	if err := readFullAt(v.r, buf, grainOffset*Sector); err != nil {
 		return nil, xerrors.Errorf("failed to read grain marker: %w", err)
 	}
-	if n != int(Sector) {
-		return nil, xerrors.Errorf(ErrReadSizeFormat, n, Sector)
-	}
 	m := parseMarker(buf)
 	if m.Type != MARKER_GRAIN {
 		return nil, xerrors.Errorf("invalid marker type: %d, expected: %d", m.Type, MARKER_GRAIN)
@@ -283,13 +301,9 @@ func (v *StreamOptimizedImage) readGrain(grainOffset int64) ([]byte, error) {
 	readAvailable := m.Size - 500
 
 	buf = make([]byte, readAvailable)
-	n, err = v.rs.Read(buf)
-	if err != nil {
+	if err := readFullAt(v.r, buf, (grainOffset+1)*Sector); err != nil {
 		return nil, xerrors.Errorf("failed to read grain data: %w", err)
 	}
-	if int64(n) != int64(readAvailable) {
-		return nil, xerrors.Errorf(ErrReadSizeFormat, n, readAvailable)
-	}
 
 	return append(m.Data, buf...), nil
 }
@@ -326,8 +340,6 @@ func parseMarker(sector []byte) *Marker {
 
 // TranslateOffset is translates the physical offset of a VMDK into a logical offset.
 func (v *StreamOptimizedImage) TranslateOffset(off int64) (int64, int64, error) {
-	var err error
-
 	// grainSize: 128
 	// sector: 512
 	// grain: 64KB (decompressed deflate)
@@ -341,21 +353,9 @@ func (v *StreamOptimizedImage) TranslateOffset(off int64) (int64, int64, error)
 	// gtSize: 32MB
 	// gtIndex: 1
 	gtIndex := off / gtSize
-	if gtIndex >= int64(len(v.GD.Entries)) {
-		return 0, 0, ErrDataNotPresent
-	}
-	gtOffset := int64(v.GD.Entries[gtIndex])
-	if gtOffset == 0 {
-		return 0, 0, ErrDataNotPresent
-	}
-	var gt GrainTable
-	gt, ok := v.GTCache[gtOffset]
-	if !ok {
-		gt, err = v.parseGrainTableEntries(gtOffset)
-		if err != nil {
-			return 0, 0, xerrors.Errorf("failed to parse grain table entries: %w", err)
-		}
-		v.GTCache[gtOffset] = gt
+	gt, err := v.grainTableAt(gtIndex)
+	if err != nil {
+		return 0, 0, err
 	}
 
 	// logical grain data offset.
@@ -370,7 +370,7 @@ func (v *StreamOptimizedImage) TranslateOffset(off int64) (int64, int64, error)
 	}
 	grainOffset := gt.Entries[entryIndex]
 	if isGTEAbsent(grainOffset, v.SparseExtentHeader.Flags) {
-		return 0, 0, ErrDataNotPresent
+		return 0, 0, absentGrainErr(grainOffset)
 	}
 
 	// dataOffset: 4KB
@@ -379,3 +379,33 @@ func (v *StreamOptimizedImage) TranslateOffset(off int64) (int64, int64, error)
 
 	return int64(grainOffset), dataOffset, nil
 }
+
+// grainTableAt returns the gtIndex-th grain table.
+func (v *StreamOptimizedImage) grainTableAt(gtIndex int64) (GrainTable, error) {
+	if v.recovered != nil {
+		gt, ok := v.recovered[gtIndex]
+		if !ok {
+			return GrainTable{}, ErrDataNotPresent
+		}
+		return gt, nil
+	}
+
+	if gtIndex >= int64(len(v.GD.Entries)) {
+		return GrainTable{}, ErrDataNotPresent
+	}
+	gtOffset := int64(v.GD.Entries[gtIndex])
+	if gtOffset == 0 {
+		return GrainTable{}, ErrDataNotPresent
+	}
+	return v.grainTable(gtOffset)
+}
+
+// grainTableEntries returns the entries of the gtIndex-th grain table, or nil
+// if it is not allocated.
+func (v *StreamOptimizedImage) grainTableEntries(gtIndex int64) ([]Entry, error) {
+	gt, err := v.grainTableAt(gtIndex)
+	if err == ErrDataNotPresent {
+		return nil, nil
+	}
+	return gt.Entries, err
+}
@@ -0,0 +1,306 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	_ io.WriteCloser = &StreamOptimizedWriter{}
+
+	ErrExceedCapacity = xerrors.New("write exceeds disk capacity")
+)
+
+// StreamOptimizedWriter writes raw disk data as a streamOptimized image.
+// The disk is written sequentially from its first byte, all-zero grains are
+// omitted, and the grain tables, grain directory and footer are written by Close.
+type StreamOptimizedWriter struct {
+	w      io.Writer
+	header Header
+
+	// offset is the number of bytes written to w.
+	offset int64
+	// pos is the number of raw disk bytes consumed by Write.
+	pos int64
+	buf []byte
+
+	// nextGrain is the smallest grain index that may be written next.
+	nextGrain int64
+	gtIndex   int64
+	gt        []Entry
+	gd        []Entry
+
+	compressed bytes.Buffer
+	zw         *zlib.Writer
+	closed     bool
+}
+
+// NewStreamOptimizedWriter writes the header and embedded descriptor of a
+// streamOptimized image of capacity bytes to w. name is the extent file name
+// recorded in the descriptor.
+func NewStreamOptimizedWriter(w io.Writer, capacity int64, name string) (*StreamOptimizedWriter, error) {
+	return newStreamOptimizedWriter(w, capacity, name, DiskDataBase{})
+}
+
+// newStreamOptimizedWriter is like NewStreamOptimizedWriter, but records the entries set in
+// ddb in the descriptor.
+func newStreamOptimizedWriter(w io.Writer, capacity int64, name string, ddb DiskDataBase) (*StreamOptimizedWriter, error) {
+	if capacity <= 0 || capacity%Sector != 0 {
+		return nil, xerrors.Errorf("invalid capacity %d: must be a positive multiple of %d", capacity, Sector)
+	}
+	dd, err := newDiskDescriptor(StreamOptimized, name, capacity/Sector, ddb)
+	if err != nil {
+		return nil, err
+	}
+	descriptor := marshalDiskDescriptor(dd)
+	descriptorSize := (int64(len(descriptor)) + Sector - 1) / Sector
+
+	header := newSparseHeader(capacity/Sector, descriptorSize)
+	header.Version = 3
+	header.Flag = int32(FlagValidNewLineDetection | FlagCompressed | FlagEmbeddedLBA)
+	header.GdOffset = GDAtEnd
+	header.CompressAlgorithm = CompressionDeflate
+
+	numGDEntries, err := numGrainDirectoryEntries(header)
+	if err != nil {
+		return nil, err
+	}
+	sw := &StreamOptimizedWriter{
+		w:      w,
+		header: header,
+		buf:    make([]byte, 0, header.GrainSize*Sector),
+		gt:     make([]Entry, header.NumGTEsPerGT),
+		gd:     make([]Entry, numGDEntries),
+	}
+	sw.zw = zlib.NewWriter(&sw.compressed)
+
+	if err := sw.write(encodeHeader(header)); err != nil {
+		return nil, xerrors.Errorf("failed to write header: %w", err)
+	}
+	if err := sw.write(padSector(descriptor)); err != nil {
+		return nil, xerrors.Errorf("failed to write descriptor: %w", err)
+	}
+	if err := sw.write(make([]byte, header.OverHead*Sector-sw.offset)); err != nil {
+		return nil, xerrors.Errorf("failed to write padding: %w", err)
+	}
+	return sw, nil
+}
+
+// WriteStreamOptimized writes the capacity bytes of disk data read from r to w
+// as a streamOptimized image.
+func WriteStreamOptimized(w io.Writer, r io.Reader, capacity int64, name string) error {
+	sw, err := NewStreamOptimizedWriter(w, capacity, name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(sw, io.LimitReader(r, capacity)); err != nil {
+		return xerrors.Errorf("failed to write disk data: %w", err)
+	}
+	return sw.Close()
+}
+
+// newSparseHeader returns a sparse extent header for capacity sectors with an
+// embedded descriptor of descriptorSize sectors at sector 1.
+func newSparseHeader(capacity, descriptorSize int64) Header {
+	overHead := 1 + descriptorSize
+	return Header{
+		Signature:          KDMV,
+		Version:            1,
+		Flag:               int32(FlagValidNewLineDetection),
+		Capacity:           capacity,
+		GrainSize:          defaultGrainSize,
+		DescriptorOffset:   1,
+		DescriptorSize:     descriptorSize,
+		NumGTEsPerGT:       defaultNumGTEsPerGT,
+		OverHead:           (overHead + defaultGrainSize - 1) / defaultGrainSize * defaultGrainSize,
+		SingleEndLineChar:  '\n',
+		NonEndLineChar:     ' ',
+		DoubleEndLineChar1: '\r',
+		DoubleEndLineChar2: '\n',
+	}
+}
+
+// padSector pads b with zeros up to a sector boundary.
+func padSector(b []byte) []byte {
+	if rem := int64(len(b)) % Sector; rem != 0 {
+		b = append(b, make([]byte, Sector-rem)...)
+	}
+	return b
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *StreamOptimizedWriter) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.offset += int64(n)
+	return err
+}
+
+func encodeHeader(h Header) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, h)
+	return buf.Bytes()
+}
+
+// writeMarker writes a metadata marker of type typ followed by data.
+func (w *StreamOptimizedWriter) writeMarker(typ uint32, data []byte) error {
+	marker := make([]byte, Sector)
+	binary.LittleEndian.PutUint64(marker[0:8], uint64(len(data))/uint64(Sector))
+	binary.LittleEndian.PutUint32(marker[12:16], typ)
+	if err := w.write(marker); err != nil {
+		return err
+	}
+	return w.write(data)
+}
+
+func encodeEntries(entries []Entry) []byte {
+	buf := make([]byte, len(entries)*4)
+	for i, e := range entries {
+		binary.LittleEndian.PutUint32(buf[i*4:], uint32(e))
+	}
+	return padSector(buf)
+}
+
+func (w *StreamOptimizedWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, xerrors.New("write to closed writer")
+	}
+	capacity := w.header.Capacity * Sector
+	var err error
+	if int64(len(p)) > capacity-w.pos {
+		p = p[:capacity-w.pos]
+		err = ErrExceedCapacity
+	}
+
+	grain := int(w.header.GrainSize * Sector)
+	n := 0
+	for n < len(p) {
+		c := copy(w.buf[len(w.buf):grain], p[n:])
+		w.buf = w.buf[:len(w.buf)+c]
+		n += c
+		w.pos += int64(c)
+		if len(w.buf) == grain {
+			if werr := w.writeGrain(w.pos/int64(grain)-1, w.buf); werr != nil {
+				return n, werr
+			}
+			w.buf = w.buf[:0]
+		}
+	}
+	return n, err
+}
+
+// writeGrain compresses and writes the grain at index. Grains must be written
+// in increasing order; all-zero grains are skipped.
+func (w *StreamOptimizedWriter) writeGrain(index int64, data []byte) error {
+	if index < w.nextGrain {
+		return xerrors.Errorf("grain %d is written out of order, next is %d", index, w.nextGrain)
+	}
+	w.nextGrain = index + 1
+
+	for gtIndex := index / int64(w.header.NumGTEsPerGT); w.gtIndex < gtIndex; {
+		if err := w.flushGrainTable(); err != nil {
+			return err
+		}
+	}
+	if isZero(data) {
+		return nil
+	}
+
+	w.compressed.Reset()
+	// The compressed stream starts after the 12 bytes of LBA and size.
+	w.compressed.Write(make([]byte, 12))
+	w.zw.Reset(&w.compressed)
+	if _, err := w.zw.Write(data); err != nil {
+		return xerrors.Errorf("failed to compress grain: %w", err)
+	}
+	if err := w.zw.Close(); err != nil {
+		return xerrors.Errorf("failed to compress grain: %w", err)
+	}
+	b := w.compressed.Bytes()
+	binary.LittleEndian.PutUint64(b[0:8], uint64(index*w.header.GrainSize))
+	binary.LittleEndian.PutUint32(b[8:12], uint32(len(b)-12))
+
+	w.gt[index%int64(w.header.NumGTEsPerGT)] = Entry(w.offset / Sector)
+	if err := w.write(padSector(b)); err != nil {
+		return xerrors.Errorf("failed to write grain: %w", err)
+	}
+	return nil
+}
+
+// flushGrainTable writes the current grain table if it has any grain, and
+// moves on to the next one.
+func (w *StreamOptimizedWriter) flushGrainTable() error {
+	if !isZeroEntries(w.gt) {
+		w.gd[w.gtIndex] = Entry(w.offset/Sector + 1)
+		if err := w.writeMarker(MARKER_GT, encodeEntries(w.gt)); err != nil {
+			return xerrors.Errorf("failed to write grain table: %w", err)
+		}
+		for i := range w.gt {
+			w.gt[i] = 0
+		}
+	}
+	w.gtIndex++
+	return nil
+}
+
+func isZeroEntries(entries []Entry) bool {
+	for _, e := range entries {
+		if e != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Close writes the pending grain, the remaining grain tables, the grain
+// directory, the footer and the end-of-stream marker. It does not close the
+// underlying writer.
+func (w *StreamOptimizedWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if len(w.buf) > 0 {
+		grain := w.header.GrainSize * Sector
+		index := w.pos / grain
+		w.buf = w.buf[:grain]
+		for i := w.pos % grain; i < grain; i++ {
+			w.buf[i] = 0
+		}
+		if err := w.writeGrain(index, w.buf); err != nil {
+			return err
+		}
+	}
+	for w.gtIndex < int64(len(w.gd)) {
+		if err := w.flushGrainTable(); err != nil {
+			return err
+		}
+	}
+
+	footer := w.header
+	footer.GdOffset = w.offset/Sector + 1
+	if err := w.writeMarker(MARKER_GD, encodeEntries(w.gd)); err != nil {
+		return xerrors.Errorf("failed to write grain directory: %w", err)
+	}
+
+	if err := w.writeMarker(MARKER_FOOTER, encodeHeader(footer)); err != nil {
+		return xerrors.Errorf("failed to write footer: %w", err)
+	}
+	// The end-of-stream marker is a zero-filled sector.
+	if err := w.write(make([]byte, Sector)); err != nil {
+		return xerrors.Errorf("failed to write end-of-stream marker: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package vmdk
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"io"
+	"math"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	_ io.Reader = &StreamReader{}
+
+	ErrGrainOutOfOrder = xerrors.New("grain is out of order")
+)
+
+// StreamReader decodes a streamOptimized image from an io.Reader, such as an
+// HTTP response body or a tar member, without seeking. It reads the markers
+// in order and places each grain at the LBA of its marker. Read returns the
+// raw disk content, which requires the grains to be in increasing LBA order,
+// while Next returns the grains one by one. A StreamReader is consumed either
+// by Read or by Next, not both.
+type StreamReader struct {
+	Header         Header
+	DiskDescriptor DiskDescriptor
+
+	r io.Reader
+	// pos is the number of bytes read from r.
+	pos int64
+	zr  io.ReadCloser
+	// grain holds the data returned by Next.
+	grain []byte
+
+	// off is the disk offset of the next byte returned by Read.
+	off int64
+	// chunk is the grain at chunkOff that Read returns next.
+	chunk    []byte
+	chunkOff int64
+	eos      bool
+}
+
+// NewStreamReader reads the header and the descriptor of the streamOptimized
+// image r.
+func NewStreamReader(r io.Reader) (*StreamReader, error) {
+	s := &StreamReader{r: r}
+	buf := make([]byte, Sector)
+	if err := s.readFull(buf); err != nil {
+		return nil, xerrors.Errorf("failed to read header: %w", err)
+	}
+	header, err := ParseHeader(bytes.NewReader(buf))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse header: %w", err)
+	}
+	flags := uint32(header.Flag)
+	if flags&FlagCompressed == 0 || flags&FlagEmbeddedLBA == 0 {
+		return nil, xerrors.Errorf("grains without markers: %w", ErrUnSupportedType)
+	}
+	// The header comes from an untrusted stream, so it must not size huge
+	// buffers or overflow the offsets.
+	if err := validateGrainGeometry(header.GrainSize, int64(header.NumGTEsPerGT)); err != nil {
+		return nil, xerrors.Errorf("invalid header: %w", err)
+	}
+	if header.DescriptorSize < 0 || header.DescriptorSize > maxTextDescriptorSize/Sector {
+		return nil, xerrors.Errorf("invalid descriptor size: %d sectors", header.DescriptorSize)
+	}
+	maxOffset := math.MaxInt64 / Sector
+	if header.DescriptorOffset < 0 || header.DescriptorOffset > maxOffset ||
+		header.OverHead < 0 || header.OverHead > maxOffset || header.Capacity < 0 || header.Capacity > maxOffset {
+		return nil, xerrors.Errorf("invalid header: descriptor offset %d, overhead %d, capacity %d",
+			header.DescriptorOffset, header.OverHead, header.Capacity)
+	}
+	s.Header = header
+
+	if header.DescriptorSize > 0 {
+		if err := s.skip(header.DescriptorOffset * Sector); err != nil {
+			return nil, xerrors.Errorf("failed to skip to descriptor: %w", err)
+		}
+		buf = make([]byte, header.DescriptorSize*Sector)
+		if err := s.readFull(buf); err != nil {
+			return nil, xerrors.Errorf("failed to read descriptor: %w", err)
+		}
+		s.DiskDescriptor, err = parseDescriptorLines(bufio.NewScanner(bytes.NewReader(buf)))
+		if err != nil {
+			return nil, xerrors.Errorf("failed to parse disk descriptor: %w", err)
+		}
+	}
+	if err := s.skip(header.OverHead * Sector); err != nil {
+		return nil, xerrors.Errorf("failed to skip metadata: %w", err)
+	}
+
+	s.grain = make([]byte, header.GrainSize*Sector)
+	return s, nil
+}
+
+// Size returns the size of the disk in bytes.
+func (s *StreamReader) Size() int64 {
+	return s.Header.Capacity * Sector
+}
+
+func (s *StreamReader) readFull(buf []byte) error {
+	n, err := io.ReadFull(s.r, buf)
+	s.pos += int64(n)
+	return err
+}
+
+// skip discards the input up to the byte offset pos.
+func (s *StreamReader) skip(pos int64) error {
+	if pos < s.pos {
+		return xerrors.Errorf("offset %d is behind the stream at %d", pos, s.pos)
+	}
+	n, err := io.CopyN(io.Discard, s.r, pos-s.pos)
+	s.pos += n
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Next returns the next grain of the stream, with the LBA in sectors at which
+// it starts. data is only valid until the next call to Next or Read. It
+// returns io.EOF at the end-of-stream marker.
+func (s *StreamReader) Next() (lba int64, data []byte, err error) {
+	sector := make([]byte, Sector)
+	for {
+		if err := s.readFull(sector); err != nil {
+			if err == io.EOF {
+				// The end-of-stream marker is missing.
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, nil, xerrors.Errorf("failed to read marker: %w", err)
+		}
+		m := parseMarker(sector)
+		switch m.Type {
+		case MARKER_GRAIN:
+			return s.readGrain(m)
+		case MARKER_GT, MARKER_GD:
+			err = s.skip(s.pos + int64(m.Value)*Sector)
+		case MARKER_FOOTER:
+			err = s.skip(s.pos + Sector)
+		case MARKER_EOS:
+			return 0, nil, io.EOF
+		default:
+			return 0, nil, xerrors.Errorf("invalid marker type: %d", m.Type)
+		}
+		if err != nil {
+			return 0, nil, xerrors.Errorf("failed to skip metadata: %w", err)
+		}
+	}
+}
+
+// readGrain reads and inflates the grain of the marker m.
+func (s *StreamReader) readGrain(m *Marker) (int64, []byte, error) {
+	data := m.Data
+	if int64(m.Size) <= int64(len(data)) {
+		data = data[:m.Size]
+	} else {
+		rest := make([]byte, (int64(m.Size)-int64(len(data))+Sector-1)/Sector*Sector)
+		if err := s.readFull(rest); err != nil {
+			return 0, nil, xerrors.Errorf("failed to read grain data: %w", err)
+		}
+		data = append(data, rest[:int64(m.Size)-int64(len(data))]...)
+	}
+
+	var err error
+	if s.zr == nil {
+		s.zr, err = zlib.NewReader(bytes.NewReader(data))
+	} else {
+		err = s.zr.(zlib.Resetter).Reset(bytes.NewReader(data), nil)
+	}
+	if err != nil {
+		return 0, nil, xerrors.Errorf("failed to read zlib error: %w", err)
+	}
+	if _, err := io.ReadFull(s.zr, s.grain); err != nil {
+		return 0, nil, xerrors.Errorf("failed to decompress deflate error: %w", err)
+	}
+	return int64(m.Value), s.grain, nil
+}
+
+// Read reads the raw disk content. The grains not in the stream read as zeros.
+// It returns ErrGrainOutOfOrder if a grain precedes the data already read.
+func (s *StreamReader) Read(p []byte) (int, error) {
+	size := s.Size()
+	if s.off >= size {
+		return 0, io.EOF
+	}
+	if !s.eos && s.chunkOff+int64(len(s.chunk)) <= s.off {
+		lba, data, err := s.Next()
+		switch {
+		case err == io.EOF:
+			s.eos = true
+			s.chunk = nil
+		case err != nil:
+			return 0, err
+		case lba*Sector < s.off:
+			return 0, xerrors.Errorf("grain at LBA %d: %w", lba, ErrGrainOutOfOrder)
+		default:
+			s.chunk, s.chunkOff = data, lba*Sector
+			if s.chunkOff+int64(len(s.chunk)) > size {
+				if s.chunkOff >= size {
+					s.chunk = nil
+				} else {
+					s.chunk = s.chunk[:size-s.chunkOff]
+				}
+			}
+		}
+	}
+
+	end := size
+	if len(s.chunk) > 0 {
+		end = s.chunkOff + int64(len(s.chunk))
+	}
+	if remaining := end - s.off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	var n int
+	if len(s.chunk) == 0 || s.off < s.chunkOff {
+		// Zeros up to the next grain.
+		if gap := s.chunkOff - s.off; len(s.chunk) > 0 && int64(len(p)) > gap {
+			p = p[:gap]
+		}
+		for i := range p {
+			p[i] = 0
+		}
+		n = len(p)
+	} else {
+		n = copy(p, s.chunk[s.off-s.chunkOff:])
+	}
+	s.off += int64(n)
+	return n, nil
+}
@@ -0,0 +1,80 @@
+package vmdk
+
+import (
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+// recoverGrainTables rebuilds the grain tables by scanning the markers of the
+// file from the end of its metadata, using the header at the start of the file
+// instead of the footer. The scan stops at the end-of-stream marker, at an
+// unknown marker or at a grain cut off by the end of the file. When a grain
+// appears more than once, the last one is used.
+func (v *StreamOptimizedImage) recoverGrainTables() error {
+	var h SparseExtentHeader
+	if err := binary.Read(io.NewSectionReader(v.r, 0, Sector), binary.LittleEndian, &h); err != nil {
+		return xerrors.Errorf("failed to read header: %w", err)
+	}
+	if h.MagicNumber != KDMV {
+		return xerrors.Errorf("invalid magick number: actual(0x%08x), expected(0x%08x)", h.MagicNumber, KDMV)
+	}
+	if err := validateIncompatFlags(h.Flags); err != nil {
+		return err
+	}
+	if h.Flags&FlagCompressed == 0 || h.Flags&FlagEmbeddedLBA == 0 {
+		return xerrors.Errorf("grains have no markers: flags 0x%08x", h.Flags)
+	}
+	// The header is not trusted to size the rebuilt grain tables.
+	if err := validateGrainGeometry(int64(h.GrainSize), int64(h.NumberGTEsPerGT)); err != nil {
+		return xerrors.Errorf("invalid header: %w", err)
+	}
+
+	// The tables are keyed by index, as the capacity is not trusted to size
+	// a slice.
+	tables := make(map[int64]GrainTable)
+
+	sectors := v.size / Sector
+	buf := make([]byte, Sector)
+	for offset := int64(h.OverHead); offset < sectors; {
+		if err := readFullAt(v.r, buf, offset*Sector); err != nil {
+			return xerrors.Errorf("failed to read marker: %w", err)
+		}
+		m := parseMarker(buf)
+		if m.Type == MARKER_GRAIN {
+			length := (12 + int64(m.Size) + Sector - 1) / Sector
+			if offset+length > sectors || m.Value%h.GrainSize != 0 || m.Value >= h.Capacity {
+				break
+			}
+			index := m.Value / h.GrainSize
+			gtIndex := int64(index / uint64(h.NumberGTEsPerGT))
+			gt, ok := tables[gtIndex]
+			if !ok {
+				gt.Entries = make([]Entry, h.NumberGTEsPerGT)
+				tables[gtIndex] = gt
+			}
+			gt.Entries[index%uint64(h.NumberGTEsPerGT)] = Entry(offset)
+			offset += length
+			continue
+		}
+
+		switch m.Type {
+		case MARKER_GT, MARKER_GD:
+			offset += 1 + int64(m.Value)
+			continue
+		case MARKER_FOOTER:
+			// The marker and the footer.
+			offset += 2
+			continue
+		}
+		// The end-of-stream marker, or garbage.
+		break
+	}
+
+	h.GdOffset = 0
+	v.SparseExtentHeader = h
+	v.GD = GrainDirectory{}
+	v.recovered = tables
+	return nil
+}
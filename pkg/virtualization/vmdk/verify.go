@@ -0,0 +1,481 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+// FindingKind classifies a problem found by Verify.
+type FindingKind int
+
+const (
+	// FindingUncleanShutdown means the image was not closed after writing.
+	FindingUncleanShutdown FindingKind = iota + 1
+	// FindingBadHeader means the header or the footer is unusable.
+	FindingBadHeader
+	// FindingBadGrainDirectory means a grain directory cannot be read.
+	FindingBadGrainDirectory
+	// FindingGrainDirectoryMismatch means the grain directory and the
+	// redundant one, or their grain tables, differ.
+	FindingGrainDirectoryMismatch
+	// FindingBadGrainTable means a grain table cannot be read.
+	FindingBadGrainTable
+	// FindingGrainPastEOF means a grain table entry points beyond the end of the file.
+	FindingGrainPastEOF
+	// FindingGrainInMetadata means a grain overlaps the header, the descriptor,
+	// a grain directory or a grain table.
+	FindingGrainInMetadata
+	// FindingOverlappingGrains means two grain table entries share sectors.
+	FindingOverlappingGrains
+	// FindingOrphanedData means a part of the file after the metadata is not
+	// referenced by any grain table.
+	FindingOrphanedData
+	// FindingBadGrain means a compressed grain has an invalid marker or an
+	// invalid zlib stream.
+	FindingBadGrain
+)
+
+func (k FindingKind) String() string {
+	switch k {
+	case FindingUncleanShutdown:
+		return "unclean shutdown"
+	case FindingBadHeader:
+		return "bad header"
+	case FindingBadGrainDirectory:
+		return "bad grain directory"
+	case FindingGrainDirectoryMismatch:
+		return "grain directory mismatch"
+	case FindingBadGrainTable:
+		return "bad grain table"
+	case FindingGrainPastEOF:
+		return "grain past EOF"
+	case FindingGrainInMetadata:
+		return "grain in metadata"
+	case FindingOverlappingGrains:
+		return "overlapping grains"
+	case FindingOrphanedData:
+		return "orphaned data"
+	case FindingBadGrain:
+		return "bad grain"
+	}
+	return "unknown"
+}
+
+// Finding is a problem found by Verify.
+type Finding struct {
+	Kind FindingKind
+	// Offset is the byte offset in the file of the structure concerned.
+	Offset int64
+	// Grain is the logical grain index concerned, or -1.
+	Grain  int64
+	Detail string
+}
+
+func (f Finding) String() string {
+	s := fmt.Sprintf("%s at offset %d", f.Kind, f.Offset)
+	if f.Grain >= 0 {
+		s += fmt.Sprintf(" (grain %d)", f.Grain)
+	}
+	if f.Detail != "" {
+		s += ": " + f.Detail
+	}
+	return s
+}
+
+// VerifyReport is the result of Verify.
+type VerifyReport struct {
+	// Header is the header of the file, or its footer if the grain directory
+	// is at the end.
+	Header   Header
+	Findings []Finding
+}
+
+// OK reports whether no problem was found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Findings) == 0
+}
+
+// usedRange is a range of sectors of the file in use.
+type usedRange struct {
+	start, end int64
+	// grain is the logical grain index, or -1 for metadata.
+	grain int64
+	name  string
+}
+
+type verifier struct {
+	r      io.ReaderAt
+	size   int64
+	header Header
+	report *VerifyReport
+
+	compressed bool
+	gtSectors  int64
+	used       []usedRange
+}
+
+// Verify checks the consistency of the sparse extent file r of size bytes by
+// walking its header, grain directories, every grain table and every grain.
+// Unlike Check, which only checks the signature, it reports every problem
+// found as a Finding. An error is returned only if r is not a sparse extent
+// or cannot be read.
+func Verify(r io.ReaderAt, size int64) (*VerifyReport, error) {
+	signature := make([]byte, 4)
+	if size < Sector {
+		return nil, ErrIsNotVMDK
+	}
+	if err := readFullAt(r, signature, 0); err != nil {
+		return nil, xerrors.Errorf("failed to read signature: %w", err)
+	}
+	if binary.LittleEndian.Uint32(signature) != KDMV {
+		return nil, ErrIsNotVMDK
+	}
+	header, err := ParseHeader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse header: %w", err)
+	}
+	v := &verifier{
+		r:          r,
+		size:       size,
+		header:     header,
+		report:     &VerifyReport{Header: header},
+		compressed: uint32(header.Flag)&FlagCompressed != 0,
+	}
+	if err := v.verify(); err != nil {
+		return nil, err
+	}
+	return v.report, nil
+}
+
+func (v *verifier) add(kind FindingKind, offset, grain int64, format string, args ...interface{}) {
+	v.report.Findings = append(v.report.Findings, Finding{
+		Kind:   kind,
+		Offset: offset,
+		Grain:  grain,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *verifier) sectors() int64 {
+	return (v.size + Sector - 1) / Sector
+}
+
+func (v *verifier) verify() error {
+	if v.header.UncleanShutdown != 0 {
+		v.add(FindingUncleanShutdown, 0, -1, "")
+	}
+	v.used = append(v.used, usedRange{start: 0, end: 1, grain: -1, name: "header"})
+
+	if v.header.GdOffset == GDAtEnd {
+		ok, err := v.readFooter()
+		if err != nil || !ok {
+			return err
+		}
+	}
+	if v.header.DescriptorSize > 0 {
+		v.used = append(v.used, usedRange{
+			start: v.header.DescriptorOffset,
+			end:   v.header.DescriptorOffset + v.header.DescriptorSize,
+			grain: -1,
+			name:  "descriptor",
+		})
+	}
+
+	numGTs, err := numGrainDirectoryEntries(v.header)
+	if err != nil {
+		v.add(FindingBadHeader, 0, -1, "%v", err)
+		return nil
+	}
+	v.gtSectors = (int64(v.header.NumGTEsPerGT)*4 + Sector - 1) / Sector
+
+	gd, ok, err := v.readDirectory("grain directory", v.header.GdOffset, numGTs)
+	if err != nil || !ok {
+		return err
+	}
+	var rgd []Entry
+	if !v.compressed && v.header.RgdOffset > 0 && uint32(v.header.Flag)&FlagUseRedundantGrainTable != 0 {
+		if rgd, ok, err = v.readDirectory("redundant grain directory", v.header.RgdOffset, numGTs); err != nil {
+			return err
+		}
+	}
+
+	for i, gtOffset := range gd {
+		if gtOffset == 0 {
+			if len(rgd) > 0 && rgd[i] != 0 {
+				v.add(FindingGrainDirectoryMismatch, v.header.GdOffset*Sector+int64(i)*4, -1,
+					"grain table %d is only in the redundant grain directory", i)
+			}
+			continue
+		}
+		gt, ok, err := v.readGrainTable(int64(gtOffset))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if len(rgd) > 0 {
+			if err := v.compareRedundantGrainTable(i, gt, int64(rgd[i])); err != nil {
+				return err
+			}
+		}
+		for j, e := range gt {
+			if err := v.verifyGrain(int64(i)*int64(v.header.NumGTEsPerGT)+int64(j), e); err != nil {
+				return err
+			}
+		}
+	}
+
+	v.checkOverlaps()
+	return nil
+}
+
+// readFooter replaces the header with the footer of a stream-optimized file.
+// ok is false if there is no usable footer.
+func (v *verifier) readFooter() (bool, error) {
+	// footer marker, footer and end-of-stream marker.
+	footerOffset := v.size - 2*Sector
+	if v.size%Sector != 0 || footerOffset < 2*Sector {
+		v.add(FindingBadHeader, 0, -1, "grain directory is at the end, but the file has no footer")
+		return false, nil
+	}
+	marker := make([]byte, Sector)
+	if err := readFullAt(v.r, marker, footerOffset-Sector); err != nil {
+		return false, xerrors.Errorf("failed to read footer marker: %w", err)
+	}
+	if m := parseMarker(marker); m.Size != 0 || m.Type != MARKER_FOOTER {
+		v.add(FindingBadHeader, footerOffset-Sector, -1, "footer marker is missing")
+		return false, nil
+	}
+	footer, err := ParseHeader(io.NewSectionReader(v.r, footerOffset, Sector))
+	if err != nil {
+		v.add(FindingBadHeader, footerOffset, -1, "invalid footer: %v", err)
+		return false, nil
+	}
+	if footer.GdOffset <= 0 {
+		v.add(FindingBadHeader, footerOffset, -1, "invalid grain directory offset in footer: %d", footer.GdOffset)
+		return false, nil
+	}
+	v.header = footer
+	v.report.Header = footer
+	v.used = append(v.used, usedRange{start: footerOffset/Sector - 1, end: v.sectors(), grain: -1, name: "footer"})
+	return true, nil
+}
+
+// readDirectory reads a grain directory of n entries at sector offset.
+// ok is false if it cannot be used.
+func (v *verifier) readDirectory(name string, offset, n int64) ([]Entry, bool, error) {
+	// 4 bytes per entry.
+	gdSectors := n / (Sector / 4)
+	if n%(Sector/4) != 0 {
+		gdSectors++
+	}
+	start := offset
+	if v.compressed {
+		// The marker precedes the grain directory.
+		start--
+	}
+	if !v.inFile(offset, gdSectors) {
+		v.add(FindingBadGrainDirectory, offset*Sector, -1, "%s of %d sectors at sector %d is out of the file", name, gdSectors, offset)
+		return nil, false, nil
+	}
+	if v.compressed {
+		if ok, err := v.checkMarker(start, MARKER_GD, FindingBadGrainDirectory); err != nil || !ok {
+			return nil, false, err
+		}
+	}
+	entries, err := v.readEntries(offset, n)
+	if err != nil {
+		return nil, false, xerrors.Errorf("failed to read %s: %w", name, err)
+	}
+	v.used = append(v.used, usedRange{start: start, end: offset + gdSectors, grain: -1, name: name})
+	return entries, true, nil
+}
+
+// readGrainTable reads the grain table at sector offset. ok is false if it
+// cannot be used.
+func (v *verifier) readGrainTable(offset int64) ([]Entry, bool, error) {
+	start := offset
+	if v.compressed {
+		start--
+	}
+	if start <= 0 || !v.inFile(offset, v.gtSectors) {
+		v.add(FindingBadGrainTable, offset*Sector, -1, "grain table at sector %d is out of the file", offset)
+		return nil, false, nil
+	}
+	if v.compressed {
+		if ok, err := v.checkMarker(start, MARKER_GT, FindingBadGrainTable); err != nil || !ok {
+			return nil, false, err
+		}
+	}
+	entries, err := v.readEntries(offset, int64(v.header.NumGTEsPerGT))
+	if err != nil {
+		return nil, false, xerrors.Errorf("failed to read grain table: %w", err)
+	}
+	v.used = append(v.used, usedRange{start: start, end: offset + v.gtSectors, grain: -1, name: "grain table"})
+	return entries, true, nil
+}
+
+// inFile reports whether the n sectors at sector offset are within the file,
+// without overflowing on corrupted values.
+func (v *verifier) inFile(offset, n int64) bool {
+	sectors := v.size / Sector
+	return offset > 0 && n >= 0 && offset <= sectors && n <= sectors-offset
+}
+
+// checkMarker checks that the metadata marker at sector offset has type typ.
+func (v *verifier) checkMarker(offset int64, typ uint32, kind FindingKind) (bool, error) {
+	buf := make([]byte, Sector)
+	if err := readFullAt(v.r, buf, offset*Sector); err != nil {
+		return false, xerrors.Errorf("failed to read marker: %w", err)
+	}
+	if m := parseMarker(buf); m.Size != 0 || m.Type != typ {
+		v.add(kind, offset*Sector, -1, "invalid marker: type %d, expected %d", m.Type, typ)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (v *verifier) readEntries(offset, n int64) ([]Entry, error) {
+	entries := make([]Entry, n)
+	if err := binary.Read(io.NewSectionReader(v.r, offset*Sector, n*4), binary.LittleEndian, entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// compareRedundantGrainTable compares the index-th grain table gt with its
+// redundant copy at sector rgtOffset.
+func (v *verifier) compareRedundantGrainTable(index int, gt []Entry, rgtOffset int64) error {
+	if rgtOffset == 0 {
+		v.add(FindingGrainDirectoryMismatch, v.header.RgdOffset*Sector+int64(index)*4, -1,
+			"grain table %d is missing in the redundant grain directory", index)
+		return nil
+	}
+	rgt, ok, err := v.readGrainTable(rgtOffset)
+	if err != nil || !ok {
+		return err
+	}
+	for j := range gt {
+		if gt[j] != rgt[j] {
+			grain := int64(index)*int64(v.header.NumGTEsPerGT) + int64(j)
+			v.add(FindingGrainDirectoryMismatch, rgtOffset*Sector+int64(j)*4, grain,
+				"grain table entry %d, redundant entry %d", gt[j], rgt[j])
+		}
+	}
+	return nil
+}
+
+// verifyGrain checks the grain table entry e of the grain at index.
+func (v *verifier) verifyGrain(index int64, e Entry) error {
+	if isGTEAbsent(e, uint32(v.header.Flag)) {
+		return nil
+	}
+	offset := int64(e)
+	if offset < 0 || offset >= v.sectors() {
+		v.add(FindingGrainPastEOF, offset*Sector, index, "grain at sector %d, file has %d sectors", offset, v.sectors())
+		return nil
+	}
+	if offset < v.header.OverHead {
+		v.add(FindingGrainInMetadata, offset*Sector, index, "grain at sector %d is before the end of metadata at sector %d", offset, v.header.OverHead)
+		return nil
+	}
+
+	length := v.header.GrainSize
+	if v.compressed {
+		var ok bool
+		var err error
+		length, ok, err = v.verifyCompressedGrain(index, offset)
+		if err != nil || !ok {
+			return err
+		}
+	}
+	if offset+length > v.sectors() {
+		v.add(FindingGrainPastEOF, offset*Sector, index, "grain of %d sectors at sector %d, file has %d sectors", length, offset, v.sectors())
+		return nil
+	}
+	v.used = append(v.used, usedRange{start: offset, end: offset + length, grain: index})
+	return nil
+}
+
+// verifyCompressedGrain checks the marker and the zlib stream of the grain at
+// sector offset, and returns its length in sectors.
+func (v *verifier) verifyCompressedGrain(index, offset int64) (int64, bool, error) {
+	buf := make([]byte, Sector)
+	if err := readFullAt(v.r, buf, offset*Sector); err != nil {
+		return 0, false, xerrors.Errorf("failed to read grain marker: %w", err)
+	}
+	lba := binary.LittleEndian.Uint64(buf[0:8])
+	size := int64(binary.LittleEndian.Uint32(buf[8:12]))
+	if size == 0 {
+		v.add(FindingBadGrain, offset*Sector, index, "grain marker has no data")
+		return 0, false, nil
+	}
+	length := (12 + size + Sector - 1) / Sector
+	if offset+length > v.sectors() {
+		v.add(FindingGrainPastEOF, offset*Sector, index, "compressed grain of %d bytes at sector %d, file has %d sectors", size, offset, v.sectors())
+		return 0, false, nil
+	}
+	if uint32(v.header.Flag)&FlagEmbeddedLBA != 0 && int64(lba) != index*v.header.GrainSize {
+		v.add(FindingBadGrain, offset*Sector, index, "grain marker has LBA %d, expected %d", lba, index*v.header.GrainSize)
+	}
+
+	data := make([]byte, size)
+	if err := readFullAt(v.r, data, offset*Sector+12); err != nil {
+		return 0, false, xerrors.Errorf("failed to read grain: %w", err)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		v.add(FindingBadGrain, offset*Sector, index, "invalid zlib stream: %v", err)
+		return length, true, nil
+	}
+	defer zr.Close()
+	n, err := io.Copy(io.Discard, zr)
+	if err != nil {
+		v.add(FindingBadGrain, offset*Sector, index, "invalid zlib stream: %v", err)
+	} else if grain := v.header.GrainSize * Sector; n != grain {
+		v.add(FindingBadGrain, offset*Sector, index, "grain inflates to %d bytes, expected %d", n, grain)
+	}
+	return length, true, nil
+}
+
+// checkOverlaps reports the ranges overlapping each other, and the parts
+// of the file after the metadata that are not in use.
+func (v *verifier) checkOverlaps() {
+	sort.SliceStable(v.used, func(i, j int) bool {
+		return v.used[i].start < v.used[j].start
+	})
+
+	var last usedRange
+	end := v.header.OverHead
+	for i, u := range v.used {
+		if i > 0 && u.start < last.end {
+			switch {
+			case u.grain >= 0 && last.grain >= 0:
+				v.add(FindingOverlappingGrains, u.start*Sector, u.grain, "grain overlaps grain %d", last.grain)
+			case u.grain >= 0:
+				v.add(FindingGrainInMetadata, u.start*Sector, u.grain, "grain overlaps %s", last.name)
+			case last.grain >= 0:
+				v.add(FindingGrainInMetadata, last.start*Sector, last.grain, "grain overlaps %s", u.name)
+			}
+		}
+		if u.start > end {
+			v.add(FindingOrphanedData, end*Sector, -1, "%d bytes are not referenced", (u.start-end)*Sector)
+		}
+		if i == 0 || u.end > last.end {
+			last = u
+		}
+		if u.end > end {
+			end = u.end
+		}
+	}
+	if end < v.sectors() {
+		v.add(FindingOrphanedData, end*Sector, -1, "%d bytes are not referenced", (v.sectors()-end)*Sector)
+	}
+}
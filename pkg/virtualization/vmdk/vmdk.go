@@ -2,8 +2,13 @@ package vmdk
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -38,6 +43,23 @@ const (
 	SectionDiskDataBase             = "the disk data base"
 	SectionDDB                      = "ddb"
 	Sector                    int64 = 0x200
+
+	// TextDescriptorSignature is the first line of a standalone descriptor file.
+	TextDescriptorSignature = "# Disk DescriptorFile"
+
+	// maxTextDescriptorSize bounds how much of a standalone descriptor file is scanned.
+	maxTextDescriptorSize = 1 << 20
+
+	// maxGrainSize bounds the grain size in sectors read from a header, so
+	// that a corrupted header cannot make a grain buffer huge.
+	maxGrainSize = 1 << 16
+	// maxNumGTEsPerGT bounds the number of entries of a grain table read from
+	// a header. VMDK always uses 512.
+	maxNumGTEsPerGT = 512
+
+	// maxParentChainDepth bounds the snapshot chain, so that a loop of
+	// parentFileNameHint is reported instead of recursing forever.
+	maxParentChainDepth = 64
 )
 
 type sectionReaderInterface interface {
@@ -55,7 +77,8 @@ type grainReader interface {
 }
 
 // readAt implements io.ReaderAt for any grainReader by looping over grains.
-func readAt(gr grainReader, p []byte, off int64) (int, error) {
+// Unallocated grains are read from parent if it is not nil.
+func readAt(gr grainReader, parent io.ReaderAt, p []byte, off int64) (int, error) {
 	totalSize := gr.Size()
 	if off >= totalSize {
 		return 0, io.EOF
@@ -70,7 +93,7 @@ func readAt(gr grainReader, p []byte, off int64) (int, error) {
 		}
 
 		grainOff, dataOff, err := gr.TranslateOffset(currentOff)
-		if err == ErrDataNotPresent {
+		if err == ErrDataNotPresent || err == ErrDataZeroed {
 			// Zero-fill up to next grain boundary or remaining buffer
 			zeroLen := grain - (currentOff % grain)
 			remaining := int64(len(p) - totalRead)
@@ -81,8 +104,14 @@ func readAt(gr grainReader, p []byte, off int64) (int, error) {
 				zeroLen = totalSize - currentOff
 			}
 			zeroSlice := p[totalRead : totalRead+int(zeroLen)]
-			for i := range zeroSlice {
-				zeroSlice[i] = 0
+			if err == ErrDataNotPresent && parent != nil {
+				if err := readParent(parent, zeroSlice, currentOff); err != nil {
+					return totalRead, xerrors.Errorf("failed to read parent: %w", err)
+				}
+			} else {
+				for i := range zeroSlice {
+					zeroSlice[i] = 0
+				}
 			}
 			totalRead += int(zeroLen)
 			continue
@@ -112,19 +141,47 @@ func readAt(gr grainReader, p []byte, off int64) (int, error) {
 	return totalRead, nil
 }
 
+// readParent reads p from the parent of a delta disk. The part of p beyond the
+// end of the parent is zero-filled, as the child may be larger than its parent.
+func readParent(parent io.ReaderAt, p []byte, off int64) error {
+	n, err := parent.ReadAt(p, off)
+	if err == io.EOF {
+		for i := n; i < len(p); i++ {
+			p[i] = 0
+		}
+		return nil
+	}
+	return err
+}
+
 var (
-	_                          sectionReaderInterface = &StreamOptimizedImage{}
-	ErrUnSupportedDividedImage                        = xerrors.New("divided images are not supported")
-	ErrUnSupportedType                                = xerrors.New("type is not supported")
-	ErrIsNotVMDK                                      = xerrors.New("this file is not vmdk")
+	_ sectionReaderInterface = &StreamOptimizedImage{}
+
+	// ErrUnSupportedDividedImage is returned by Open for images that consist of
+	// several extent files. Use OpenWithOpener to read them.
+	ErrUnSupportedDividedImage = xerrors.New("divided images are not supported")
+	ErrUnSupportedType         = xerrors.New("type is not supported")
+	ErrIsNotVMDK               = xerrors.New("this file is not vmdk")
+	ErrNoExtentOpener          = xerrors.New("extent opener is required")
+	ErrBrokenChain             = xerrors.New("broken snapshot chain")
 )
 
 type VMDK struct {
 	Header         Header
 	DiskDescriptor DiskDescriptor
-	cache          Cache[string, []byte]
+	cache          Cache[CacheKey, []byte]
+
+	// r is the image file. All reads are positional, so that an image can be
+	// read from several goroutines at once.
+	r    io.ReaderAt
+	size int64
+	// parent is the parent disk of a delta disk, covering the same range as this image.
+	parent io.ReaderAt
+	opts   options
+}
 
-	rs io.ReadSeeker
+func (v *VMDK) cacheKey(offset int64) CacheKey {
+	return CacheKey{Namespace: v.opts.namespace, Offset: offset}
 }
 
 func (v *VMDK) Size() int64 {
@@ -136,11 +193,34 @@ func (v *VMDK) Size() int64 {
 }
 
 type DiskDescriptor struct {
-	Version    int
-	CID        string
-	ParentCID  string
-	CreateType string
-	Extents    []ExtentDescription
+	Version            int
+	CID                string
+	ParentCID          string
+	ParentFileNameHint string
+	CreateType         string
+	Extents            []ExtentDescription
+	DDB                DiskDataBase
+}
+
+// DiskDataBase holds the ddb.* entries of the disk descriptor.
+type DiskDataBase struct {
+	AdapterType      string
+	VirtualHWVersion int
+	UUID             string
+	LongContentID    string
+	ToolsVersion     string
+	Geometry         Geometry
+
+	// Extra holds the entries without a field above, and those whose value
+	// does not parse, keyed by their full name (e.g. "ddb.thinProvisioned").
+	Extra map[string]string
+}
+
+// Geometry is the legacy CHS geometry of the disk.
+type Geometry struct {
+	Cylinders int64
+	Heads     int64
+	Sectors   int64
 }
 
 type ExtentDescription struct {
@@ -148,6 +228,8 @@ type ExtentDescription struct {
 	Size int64
 	Type string
 	Name string
+	// Offset is the start of the extent data in sectors, used by FLAT extents.
+	Offset int64
 }
 
 func Check(r io.Reader) (bool, error) {
@@ -179,6 +261,14 @@ func isGTEAbsent(entry Entry, flags uint32) bool {
 		(entry == GTEZeroed && flags&FlagUseZeroedGrainTableEntry != 0)
 }
 
+// absentGrainErr returns the TranslateOffset error for an absent grain table entry.
+func absentGrainErr(entry Entry) error {
+	if entry == GTEZeroed {
+		return ErrDataZeroed
+	}
+	return ErrDataNotPresent
+}
+
 // validateIncompatFlags rejects unknown incompatible flags and
 // validates flag combinations per the VMDK spec.
 func validateIncompatFlags(flags uint32) error {
@@ -192,26 +282,149 @@ func validateIncompatFlags(flags uint32) error {
 	return nil
 }
 
-func Open(rs io.ReadSeeker, cache Cache[string, []byte]) (*io.SectionReader, error) {
-	var err error
+// validateGrainGeometry checks that the grain size in sectors is a power of
+// two up to maxGrainSize, and that the number of entries of a grain table is
+// positive and up to maxNumGTEsPerGT, before they are used to size buffers.
+func validateGrainGeometry(grainSize, numGTEsPerGT int64) error {
+	if grainSize <= 0 || grainSize > maxGrainSize || grainSize&(grainSize-1) != 0 {
+		return xerrors.Errorf("invalid grain size: %d sectors", grainSize)
+	}
+	if numGTEsPerGT <= 0 || numGTEsPerGT > maxNumGTEsPerGT {
+		return xerrors.Errorf("invalid number of grain table entries: %d", numGTEsPerGT)
+	}
+	return nil
+}
+
+// isTextDescriptor sniffs the beginning of rs and reports whether it is a
+// standalone text descriptor rather than a sparse extent with a KDMV header.
+// rs is rewound to the start on success.
+func isTextDescriptor(rs io.ReadSeeker) (bool, error) {
+	buf := make([]byte, len(TextDescriptorSignature))
+	n, err := io.ReadFull(rs, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, xerrors.Errorf("failed to read signature: %w", err)
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return false, xerrors.Errorf("failed to seek to start: %w", err)
+	}
+
+	switch {
+	case n >= 4 && binary.LittleEndian.Uint32(buf) == KDMV:
+		return false, nil
+	case n == len(buf) && strings.EqualFold(string(buf), TextDescriptorSignature):
+		return true, nil
+	}
+	return false, ErrIsNotVMDK
+}
+
+// ReadDiskDescriptor parses the disk descriptor of rs, which is either a
+// sparse extent with an embedded descriptor or a standalone text descriptor.
+func ReadDiskDescriptor(rs io.ReadSeeker) (DiskDescriptor, error) {
+	text, err := isTextDescriptor(rs)
+	if err != nil {
+		return DiskDescriptor{}, err
+	}
+	if text {
+		return ParseTextDiskDescriptor(io.LimitReader(rs, maxTextDescriptorSize))
+	}
+
+	header, err := ParseHeader(rs)
+	if err != nil {
+		return DiskDescriptor{}, xerrors.Errorf("failed to parse header: %w", err)
+	}
+	return ParseDiskDescriptor(rs, header)
+}
+
+// Open opens a sparse VMDK image. rs may also be a standalone text descriptor,
+// but as its extents live in other files, OpenWithOpener is needed to read it.
+//
+// The returned reader is safe for concurrent use, provided that cache is.
+// If rs does not implement io.ReaderAt, its Seek and Read calls are serialized.
+func Open(rs io.ReadSeeker, cache Cache[CacheKey, []byte], opts ...Option) (*Disk, error) {
+	return OpenWithOpener(rs, nil, cache, opts...)
+}
+
+// OpenWithOpener is like Open, but opens the extent files of divided images
+// and standalone text descriptors with open. The parent of a delta disk is
+// opened with open as well, following parentFileNameHint.
+func OpenWithOpener(rs io.ReadSeeker, open ExtentOpener, cache Cache[CacheKey, []byte], opts ...Option) (*Disk, error) {
+	ra, size, err := newReaderAt(rs)
+	if err != nil {
+		return nil, err
+	}
+	return OpenReaderAt(ra, size, open, cache, opts...)
+}
 
+// OpenReaderAt is like OpenWithOpener, but reads the image from r of size bytes,
+// such as a memory-mapped file or an HTTP range reader. r is only read
+// positionally, so it may be shared with other goroutines. open may be nil
+// for single-file images without a parent.
+func OpenReaderAt(r io.ReaderAt, size int64, open ExtentOpener, cache Cache[CacheKey, []byte], opts ...Option) (*Disk, error) {
+	if size < 0 {
+		return nil, xerrors.Errorf("invalid size: %d", size)
+	}
 	// If cache is not provided, use mock.
 	if cache == nil {
-		cache = &mockCache[string, []byte]{}
+		cache = &mockCache[CacheKey, []byte]{}
 	}
-	v := VMDK{rs: rs, cache: cache}
-	v.Header, err = ParseHeader(v.rs)
+	files := &openedFiles{}
+	img, dd, err := openImage(r, size, files.wrap(open), cache, newOptions(opts), 0)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to parse header: %w", err)
+		files.close()
+		return nil, err
 	}
 
-	v.DiskDescriptor, err = ParseDiskDescriptor(v.rs, v.Header)
+	d := newDisk(img)
+	d.files = files
+	d.ddb = dd.DDB
+	return d, nil
+}
+
+// openImage opens the disk of the file ra of size bytes. depth is the number
+// of delta disks opened before reaching ra.
+func openImage(ra io.ReaderAt, size int64, open ExtentOpener, cache Cache[CacheKey, []byte], o options, depth int) (sectionReaderInterface, DiskDescriptor, error) {
+	v := VMDK{r: ra, size: size, cache: cache, opts: o}
+
+	// The section reader is only used while opening, by a single goroutine.
+	rs := io.NewSectionReader(ra, 0, size)
+	text, err := isTextDescriptor(rs)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to parse disk descriptor: %w", err)
+		return nil, DiskDescriptor{}, xerrors.Errorf("failed to detect descriptor: %w", err)
 	}
-	if len(v.DiskDescriptor.Extents) != 1 {
-		// TODO: Support divided image (e.g. image1.vmdk, image2.vmdk, ... )
-		return nil, ErrUnSupportedDividedImage
+	if text {
+		v.DiskDescriptor, err = ParseTextDiskDescriptor(io.LimitReader(rs, maxTextDescriptorSize))
+		if err != nil {
+			return nil, DiskDescriptor{}, xerrors.Errorf("failed to parse disk descriptor: %w", err)
+		}
+	} else {
+		v.Header, err = ParseHeader(rs)
+		if err != nil {
+			return nil, DiskDescriptor{}, xerrors.Errorf("failed to parse header: %w", err)
+		}
+
+		v.DiskDescriptor, err = ParseDiskDescriptor(rs, v.Header)
+		if err != nil {
+			return nil, DiskDescriptor{}, xerrors.Errorf("failed to parse disk descriptor: %w", err)
+		}
+	}
+
+	v.parent, err = openParent(v.DiskDescriptor, open, cache, o, depth)
+	if err != nil {
+		return nil, DiskDescriptor{}, err
+	}
+
+	if text || len(v.DiskDescriptor.Extents) != 1 {
+		if open == nil {
+			if text {
+				return nil, DiskDescriptor{}, ErrNoExtentOpener
+			}
+			return nil, DiskDescriptor{}, ErrUnSupportedDividedImage
+		}
+		r, err := NewMultiExtentImage(v, open)
+		if err != nil {
+			return nil, DiskDescriptor{}, xerrors.Errorf("failed to new multi-extent image: %w", err)
+		}
+		return r, v.DiskDescriptor, nil
 	}
 
 	var r sectionReaderInterface
@@ -219,18 +432,81 @@ func Open(rs io.ReadSeeker, cache Cache[string, []byte]) (*io.SectionReader, err
 	case StreamOptimized:
 		r, err = NewStreamOptimizedImage(v)
 		if err != nil {
-			return nil, xerrors.Errorf("failed to new stream-optimized image: %w", err)
+			return nil, DiskDescriptor{}, xerrors.Errorf("failed to new stream-optimized image: %w", err)
 		}
 	case MonolithicSparse:
 		r, err = NewMonolithicSparseImage(v)
 		if err != nil {
-			return nil, xerrors.Errorf("failed to new monolithic-sparse image: %w", err)
+			return nil, DiskDescriptor{}, xerrors.Errorf("failed to new monolithic-sparse image: %w", err)
 		}
 	default:
-		return nil, xerrors.Errorf("%s: %w", v.DiskDescriptor.CreateType, ErrUnSupportedType)
+		return nil, DiskDescriptor{}, xerrors.Errorf("%s: %w", v.DiskDescriptor.CreateType, ErrUnSupportedType)
+	}
+
+	return r, v.DiskDescriptor, nil
+}
+
+// openParent opens the parent disk of dd, or returns nil if dd is not a delta disk.
+func openParent(dd DiskDescriptor, open ExtentOpener, cache Cache[CacheKey, []byte], o options, depth int) (io.ReaderAt, error) {
+	if dd.ParentCID == "" || strings.EqualFold(dd.ParentCID, NoParentCID) {
+		return nil, nil
+	}
+	if open == nil {
+		return nil, xerrors.Errorf("failed to open parent %q: %w", dd.ParentFileNameHint, ErrNoExtentOpener)
+	}
+	if dd.ParentFileNameHint == "" {
+		return nil, xerrors.Errorf("parentFileNameHint is missing for parentCID %s: %w", dd.ParentCID, ErrBrokenChain)
+	}
+	if depth >= maxParentChainDepth {
+		return nil, xerrors.Errorf("parent chain is deeper than %d: %w", maxParentChainDepth, ErrBrokenChain)
+	}
+
+	ra, err := open(dd.ParentFileNameHint)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open parent %q (%v): %w", dd.ParentFileNameHint, err, ErrBrokenChain)
+	}
+	size, err := readerAtSize(ra)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get size of parent %q: %w", dd.ParentFileNameHint, err)
+	}
+
+	o.namespace = childNamespace(o.namespace, dd.ParentFileNameHint)
+	r, pdd, err := openImage(ra, size, open, cache, o, depth+1)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open parent %q: %w", dd.ParentFileNameHint, err)
+	}
+	if !strings.EqualFold(pdd.CID, dd.ParentCID) {
+		return nil, xerrors.Errorf("parent %q has CID %s, expected %s: %w", dd.ParentFileNameHint, pdd.CID, dd.ParentCID, ErrBrokenChain)
 	}
 
-	return io.NewSectionReader(r, io.SeekStart, r.Size()), nil
+	return r, nil
+}
+
+// OpenExtents opens a disk whose extents are stored in separate files, such as
+// twoGbMaxExtentSparse images. Each extent named in dd is opened with open and
+// the extents are concatenated in descriptor order.
+func OpenExtents(dd DiskDescriptor, open ExtentOpener, cache Cache[CacheKey, []byte], opts ...Option) (*Disk, error) {
+	if cache == nil {
+		cache = &mockCache[CacheKey, []byte]{}
+	}
+	o := newOptions(opts)
+	files := &openedFiles{}
+	open = files.wrap(open)
+	parent, err := openParent(dd, open, cache, o, 0)
+	if err != nil {
+		files.close()
+		return nil, err
+	}
+	r, err := NewMultiExtentImage(VMDK{DiskDescriptor: dd, cache: cache, parent: parent, opts: o}, open)
+	if err != nil {
+		files.close()
+		return nil, xerrors.Errorf("failed to new multi-extent image: %w", err)
+	}
+
+	d := newDisk(r)
+	d.files = files
+	d.ddb = dd.DDB
+	return d, nil
 }
 
 func ParseDiskDescriptor(rs io.ReadSeeker, header Header) (DiskDescriptor, error) {
@@ -245,24 +521,211 @@ func ParseDiskDescriptor(rs io.ReadSeeker, header Header) (DiskDescriptor, error
 	return parseDescriptorLines(bufio.NewScanner(io.LimitReader(rs, Sector*header.DescriptorSize)))
 }
 
+// ParseTextDiskDescriptor parses a standalone text descriptor file, as used by
+// monolithicFlat and split images.
+func ParseTextDiskDescriptor(r io.Reader) (DiskDescriptor, error) {
+	return parseDescriptorLines(bufio.NewScanner(r))
+}
+
+// newDiskDescriptor returns the descriptor of a new single-extent sparse disk
+// of capacity sectors. The entries set in ddb, such as those of the disk the
+// image is converted from, replace the default ones.
+func newDiskDescriptor(createType, name string, capacity int64, ddb DiskDataBase) (DiskDescriptor, error) {
+	cid, err := newCID()
+	if err != nil {
+		return DiskDescriptor{}, err
+	}
+	cylinders := capacity / (16 * 63)
+	if cylinders > 16383 {
+		cylinders = 16383
+	}
+	dd := DiskDescriptor{
+		Version:    1,
+		CID:        cid,
+		ParentCID:  NoParentCID,
+		CreateType: createType,
+		Extents: []ExtentDescription{
+			{Mode: "RW", Size: capacity, Type: SPARSE, Name: name},
+		},
+		DDB: DiskDataBase{
+			AdapterType:      "ide",
+			VirtualHWVersion: 4,
+			ToolsVersion:     "2147483647",
+			Geometry:         Geometry{Cylinders: cylinders, Heads: 16, Sectors: 63},
+		},
+	}
+	if ddb.AdapterType != "" {
+		dd.DDB.AdapterType = ddb.AdapterType
+	}
+	if ddb.VirtualHWVersion != 0 {
+		dd.DDB.VirtualHWVersion = ddb.VirtualHWVersion
+	}
+	if ddb.ToolsVersion != "" {
+		dd.DDB.ToolsVersion = ddb.ToolsVersion
+	}
+	if ddb.Geometry != (Geometry{}) {
+		dd.DDB.Geometry = ddb.Geometry
+	}
+	dd.DDB.UUID = ddb.UUID
+	dd.DDB.LongContentID = ddb.LongContentID
+	dd.DDB.Extra = ddb.Extra
+	return dd, nil
+}
+
+// newCID returns a random content ID. It must differ between images, as it
+// links delta disks to their parents.
+func newCID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", xerrors.Errorf("failed to generate CID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// marshalDiskDescriptor encodes dd in the text descriptor format.
+func marshalDiskDescriptor(dd DiskDescriptor) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s\n", TextDescriptorSignature)
+	fmt.Fprintf(&b, "version=%d\n", dd.Version)
+	fmt.Fprintf(&b, "CID=%s\n", dd.CID)
+	fmt.Fprintf(&b, "parentCID=%s\n", dd.ParentCID)
+	if dd.ParentFileNameHint != "" {
+		fmt.Fprintf(&b, "parentFileNameHint=\"%s\"\n", dd.ParentFileNameHint)
+	}
+	fmt.Fprintf(&b, "createType=\"%s\"\n", dd.CreateType)
+
+	b.WriteString("\n# Extent description\n")
+	for _, e := range dd.Extents {
+		switch {
+		case e.Type == ZERO:
+			fmt.Fprintf(&b, "%s %d %s\n", e.Mode, e.Size, e.Type)
+		case e.Type == FLAT || e.Offset != 0:
+			fmt.Fprintf(&b, "%s %d %s \"%s\" %d\n", e.Mode, e.Size, e.Type, e.Name, e.Offset)
+		default:
+			fmt.Fprintf(&b, "%s %d %s \"%s\"\n", e.Mode, e.Size, e.Type, e.Name)
+		}
+	}
+
+	b.WriteString("\n# The Disk Data Base\n#DDB\n\n")
+	ddb := dd.DDB
+	entries := map[string]string{}
+	for k, v := range ddb.Extra {
+		entries[k] = v
+	}
+	if ddb.AdapterType != "" {
+		entries["ddb.adapterType"] = ddb.AdapterType
+	}
+	if ddb.VirtualHWVersion != 0 {
+		entries["ddb.virtualHWVersion"] = strconv.Itoa(ddb.VirtualHWVersion)
+	}
+	if ddb.UUID != "" {
+		entries["ddb.uuid"] = ddb.UUID
+	}
+	if ddb.LongContentID != "" {
+		entries["ddb.longContentID"] = ddb.LongContentID
+	}
+	if ddb.ToolsVersion != "" {
+		entries["ddb.toolsVersion"] = ddb.ToolsVersion
+	}
+	// Geometry values that did not parse are kept in Extra.
+	if ddb.Geometry.Cylinders != 0 {
+		entries["ddb.geometry.cylinders"] = strconv.FormatInt(ddb.Geometry.Cylinders, 10)
+	}
+	if ddb.Geometry.Heads != 0 {
+		entries["ddb.geometry.heads"] = strconv.FormatInt(ddb.Geometry.Heads, 10)
+	}
+	if ddb.Geometry.Sectors != 0 {
+		entries["ddb.geometry.sectors"] = strconv.FormatInt(ddb.Geometry.Sectors, 10)
+	}
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s = \"%s\"\n", k, entries[k])
+	}
+	return b.Bytes()
+}
+
 func parseDiskDataBase(line string, dd *DiskDescriptor) error {
-	// TODO: parse not yet ...
+	if !strings.HasPrefix(line, "ddb.") {
+		return nil
+	}
+	kv := strings.SplitN(line, "=", 2)
+	if len(kv) != 2 {
+		// The disk data base is informational, so malformed entries are
+		// skipped rather than failing to open the disk.
+		return nil
+	}
+	key := strings.TrimSpace(kv[0])
+	value := strings.Trim(strings.TrimSpace(kv[1]), "\"")
+
+	var err error
+	ddb := &dd.DDB
+	switch key {
+	case "ddb.adapterType":
+		ddb.AdapterType = value
+	case "ddb.virtualHWVersion":
+		var n int
+		if n, err = strconv.Atoi(value); err == nil {
+			ddb.VirtualHWVersion = n
+		}
+	case "ddb.uuid":
+		ddb.UUID = value
+	case "ddb.longContentID":
+		ddb.LongContentID = value
+	case "ddb.toolsVersion":
+		ddb.ToolsVersion = value
+	case "ddb.geometry.cylinders":
+		err = parseGeometry(value, &ddb.Geometry.Cylinders)
+	case "ddb.geometry.heads":
+		err = parseGeometry(value, &ddb.Geometry.Heads)
+	case "ddb.geometry.sectors":
+		err = parseGeometry(value, &ddb.Geometry.Sectors)
+	default:
+		ddb.setExtra(key, value)
+	}
+	if err != nil {
+		// Keep the values that do not parse as is.
+		ddb.setExtra(key, value)
+	}
 	return nil
 }
 
+// parseGeometry sets *n to the value of a geometry entry if it parses.
+func parseGeometry(value string, n *int64) error {
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return err
+	}
+	*n = v
+	return nil
+}
+
+func (ddb *DiskDataBase) setExtra(key, value string) {
+	if ddb.Extra == nil {
+		ddb.Extra = make(map[string]string)
+	}
+	ddb.Extra[key] = value
+}
+
 func parseExtentDescription(line string, dd *DiskDescriptor) error {
 	if strings.HasPrefix(line, "#") {
 		return nil
 	}
 	ss := strings.Fields(line)
-	if len(ss) < 4 {
+	// ZERO extents have no file name.
+	if len(ss) < 4 && !(len(ss) == 3 && ss[2] == ZERO) {
 		return xerrors.Errorf("failed to parse disk extents: %s", line)
 	}
 
 	extent := ExtentDescription{
 		Mode: ss[0],
 		Type: ss[2],
-		Name: strings.Trim(ss[3], "\""),
+	}
+	if len(ss) > 3 {
+		extent.Name = strings.Trim(ss[3], "\"")
 	}
 
 	var err error
@@ -271,6 +734,21 @@ func parseExtentDescription(line string, dd *DiskDescriptor) error {
 		return xerrors.Errorf("failed to parse disk size: %s", ss[1])
 	}
 
+	// The file name is quoted and may contain spaces.
+	var rest []string
+	if start, end := strings.Index(line, "\""), strings.LastIndex(line, "\""); start >= 0 && start < end {
+		extent.Name = line[start+1 : end]
+		rest = strings.Fields(line[end+1:])
+	} else if len(ss) > 4 {
+		rest = ss[4:]
+	}
+	if len(rest) > 0 {
+		extent.Offset, err = strconv.ParseInt(rest[0], 0, 64)
+		if err != nil {
+			return xerrors.Errorf("failed to parse extent offset: %s", rest[0])
+		}
+	}
+
 	dd.Extents = append(dd.Extents, extent)
 
 	return nil
@@ -291,6 +769,8 @@ func parseDiskDescriptorFile(line string, dd *DiskDescriptor) error {
 		dd.CreateType = strings.Trim(strings.TrimPrefix(line, "createType="), "\"")
 	case strings.HasPrefix(line, "parentCID="):
 		dd.ParentCID = strings.TrimPrefix(line, "parentCID=")
+	case strings.HasPrefix(line, "parentFileNameHint="):
+		dd.ParentFileNameHint = strings.Trim(strings.TrimPrefix(line, "parentFileNameHint="), "\"")
 	}
 	return nil
 }
@@ -299,7 +779,12 @@ func parseDescriptorLines(scanner *bufio.Scanner) (DiskDescriptor, error) {
 	var descriptor DiskDescriptor
 	var currentSectionFunc func(string, *DiskDescriptor) error
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+		line := scanner.Text()
+		// An embedded descriptor is padded with NUL up to DescriptorSize.
+		if i := strings.IndexByte(line, 0); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
 		if line == "" {
 			continue
 		}
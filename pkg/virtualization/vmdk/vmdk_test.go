@@ -3,11 +3,18 @@ package vmdk_test
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
 
 	"github.com/masahiro331/go-vmdk-parser/pkg/virtualization/vmdk"
 )
@@ -37,6 +44,12 @@ func TestParseDiskDescriptor(t *testing.T) {
 						Name: "vmdk-streamoptimized.img",
 					},
 				},
+				DDB: vmdk.DiskDataBase{
+					AdapterType:      "ide",
+					VirtualHWVersion: 4,
+					ToolsVersion:     "2147483647",
+					Geometry:         vmdk.Geometry{Cylinders: 0, Heads: 16, Sectors: 63},
+				},
 			},
 		},
 		{
@@ -57,6 +70,12 @@ func TestParseDiskDescriptor(t *testing.T) {
 						Name: "vmdk-monolith.img",
 					},
 				},
+				DDB: vmdk.DiskDataBase{
+					AdapterType:      "ide",
+					VirtualHWVersion: 4,
+					ToolsVersion:     "2147483647",
+					Geometry:         vmdk.Geometry{Cylinders: 0, Heads: 16, Sectors: 63},
+				},
 			},
 		},
 		{
@@ -361,3 +380,2166 @@ func TestNewMonolithicSparseImageInvalidHeader(t *testing.T) {
 		})
 	}
 }
+
+func TestNewStreamOptimizedImageInvalidFooter(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	var image bytes.Buffer
+	if err := vmdk.WriteStreamOptimized(&image, bytes.NewReader(patternData(2*grain, 1)), int64(2*grain), "disk.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+	// The footer is followed by the end-of-stream marker.
+	footer := image.Len() - 2*int(vmdk.Sector)
+
+	tests := []struct {
+		name  string
+		field int
+	}{
+		{"GrainSize is zero", 20},
+		{"NumberGTEsPerGT is zero", 44},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := append([]byte(nil), image.Bytes()...)
+			binary.LittleEndian.PutUint32(b[footer+tt.field:], 0)
+			if _, err := vmdk.Open(bytes.NewReader(b), nil); err == nil {
+				t.Fatal("Open() should return error for invalid footer")
+			}
+		})
+	}
+}
+
+// buildMonolithicSparse builds an in-memory monolithicSparse extent holding data.
+// len(data) must be a multiple of the 64 KiB grain. All-zero grains are left unallocated.
+// descriptorLines are appended to the "Disk DescriptorFile" section, overriding its defaults.
+func buildMonolithicSparse(t *testing.T, data []byte, name string, descriptorLines ...string) []byte {
+	t.Helper()
+	const grainSize, numGTEsPerGT = 128, 512
+	grain := grainSize * int(vmdk.Sector)
+	if len(data)%grain != 0 {
+		t.Fatalf("data length %d is not a multiple of grain %d", len(data), grain)
+	}
+	capacity := int64(len(data)) / vmdk.Sector
+	numGrains := len(data) / grain
+	numGTs := (numGrains + numGTEsPerGT - 1) / numGTEsPerGT
+	gdSectors := (numGTs*4 + int(vmdk.Sector) - 1) / int(vmdk.Sector)
+	gtSectors := numGTEsPerGT * 4 / int(vmdk.Sector)
+
+	gdOffset := int64(2)
+	gtOffset := gdOffset + int64(gdSectors)
+	overHead := gtOffset + int64(numGTs*gtSectors)
+	overHead = (overHead + grainSize - 1) / grainSize * grainSize
+
+	descriptor := "# Disk DescriptorFile\nversion=1\nCID=fffffffe\nparentCID=ffffffff\ncreateType=\"monolithicSparse\"\n"
+	for _, line := range descriptorLines {
+		descriptor += line + "\n"
+	}
+	descriptor += "# Extent description\nRW " + strconv.FormatInt(capacity, 10) + " SPARSE \"" + name + "\"\n"
+
+	out := make([]byte, overHead*vmdk.Sector)
+	copy(out, makeHeader(vmdk.Header{
+		Signature:        0x564d444b,
+		Version:          1,
+		Flag:             3,
+		Capacity:         capacity,
+		GrainSize:        grainSize,
+		DescriptorOffset: 1,
+		DescriptorSize:   1,
+		NumGTEsPerGT:     numGTEsPerGT,
+		GdOffset:         gdOffset,
+		OverHead:         overHead,
+	}))
+	copy(out[vmdk.Sector:2*vmdk.Sector], descriptor)
+	for i := 0; i < numGTs; i++ {
+		off := gdOffset*vmdk.Sector + int64(i*4)
+		binary.LittleEndian.PutUint32(out[off:], uint32(gtOffset)+uint32(i*gtSectors))
+	}
+	for i := 0; i < numGrains; i++ {
+		g := data[i*grain : (i+1)*grain]
+		if bytes.Count(g, []byte{0}) == len(g) {
+			continue
+		}
+		off := gtOffset*vmdk.Sector + int64(i*4)
+		binary.LittleEndian.PutUint32(out[off:], uint32(int64(len(out))/vmdk.Sector))
+		out = append(out, g...)
+	}
+	return out
+}
+
+// patternData returns n bytes of non-zero data that differs per sector.
+func patternData(n int, seed byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i/int(vmdk.Sector)) + seed + 1
+	}
+	return b
+}
+
+func TestOpenExtents(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	first := patternData(2*grain, 0)
+	second := append(make([]byte, grain), patternData(grain, 7)...)
+	files := map[string][]byte{
+		"disk-s001.vmdk": buildMonolithicSparse(t, first, "disk-s001.vmdk"),
+		"disk-s002.vmdk": buildMonolithicSparse(t, second, "disk-s002.vmdk"),
+	}
+	dd := vmdk.DiskDescriptor{
+		Version:    1,
+		CreateType: "twoGbMaxExtentSparse",
+		Extents: []vmdk.ExtentDescription{
+			{Mode: "RW", Size: int64(len(first)) / vmdk.Sector, Type: "SPARSE", Name: "disk-s001.vmdk"},
+			{Mode: "RW", Size: int64(len(second)) / vmdk.Sector, Type: "SPARSE", Name: "disk-s002.vmdk"},
+		},
+	}
+
+	sr, err := vmdk.OpenExtents(dd, vmdk.MapOpener(files), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte{}, first...), second...)
+	if sr.Size() != int64(len(want)) {
+		t.Fatalf("Size() = %d, want %d", sr.Size(), len(want))
+	}
+
+	got, err := io.ReadAll(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("ReadAll() content mismatch")
+	}
+
+	// A read crossing the extent boundary.
+	buf := make([]byte, 1024)
+	if _, err := sr.ReadAt(buf, int64(len(first))-512); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, want[len(first)-512:len(first)+512]) {
+		t.Error("ReadAt() across extents content mismatch")
+	}
+}
+
+func TestOpenExtentsMissingFile(t *testing.T) {
+	dd := vmdk.DiskDescriptor{
+		Extents: []vmdk.ExtentDescription{
+			{Mode: "RW", Size: 128, Type: "SPARSE", Name: "missing.vmdk"},
+		},
+	}
+	_, err := vmdk.OpenExtents(dd, vmdk.MapOpener(nil), nil)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("OpenExtents() err = %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestExtentOpeners(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	data := patternData(grain, 3)
+	extent := buildMonolithicSparse(t, data, "disk-s001.vmdk")
+	dd := vmdk.DiskDescriptor{
+		Extents: []vmdk.ExtentDescription{
+			{Mode: "RW", Size: int64(len(data)) / vmdk.Sector, Type: "SPARSE", Name: "disk-s001.vmdk"},
+		},
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "disk-s001.vmdk"), extent, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		open vmdk.ExtentOpener
+	}{
+		{
+			name: "directory",
+			open: vmdk.DirOpener(dir),
+		},
+		{
+			name: "fs.FS",
+			open: vmdk.FSOpener(fstest.MapFS{"disk-s001.vmdk": &fstest.MapFile{Data: extent}}),
+		},
+		{
+			name: "in-memory",
+			open: vmdk.MapOpener(map[string][]byte{"disk-s001.vmdk": extent}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sr, err := vmdk.OpenExtents(dd, tt.open, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(sr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("ReadAll() content mismatch")
+			}
+		})
+	}
+
+	open := vmdk.DirOpener(dir)
+	for _, name := range []string{"/vmfs/volumes/ds/vm/disk-s001.vmdk", `C:\VMs\vm\disk-s001.vmdk`, "./disk-s001.vmdk"} {
+		ra, err := open(name)
+		if err != nil {
+			t.Errorf("DirOpener(%q) error = %v", name, err)
+			continue
+		}
+		ra.(io.Closer).Close()
+	}
+	for _, name := range []string{"../disk-s001.vmdk", "sub/../../disk-s001.vmdk", ".."} {
+		if _, err := open(name); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("DirOpener(%q) error = %v, want %v", name, err, fs.ErrInvalid)
+		}
+	}
+
+	// Close closes the extent files opened by the opener.
+	d, err := vmdk.OpenExtents(dd, open, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.ReadAt(make([]byte, 1), 0); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("ReadAt() after Close error = %v, want %v", err, os.ErrClosed)
+	}
+}
+
+func TestParseTextDiskDescriptor(t *testing.T) {
+	descriptor := `# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="twoGbMaxExtentFlat"
+
+# Extent description
+RW 4192256 FLAT "my disk-f001.vmdk" 0
+RW 2048 FLAT "my disk-f002.vmdk" 16
+`
+	got, err := vmdk.ParseTextDiskDescriptor(strings.NewReader(descriptor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := vmdk.DiskDescriptor{
+		Version:    1,
+		CID:        "fffffffe",
+		ParentCID:  "ffffffff",
+		CreateType: "twoGbMaxExtentFlat",
+		Extents: []vmdk.ExtentDescription{
+			{Mode: "RW", Size: 4192256, Type: "FLAT", Name: "my disk-f001.vmdk"},
+			{Mode: "RW", Size: 2048, Type: "FLAT", Name: "my disk-f002.vmdk", Offset: 16},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseTextDiskDescriptor() got = %v, want %v", got, want)
+	}
+}
+
+func TestOpenExtentsFlat(t *testing.T) {
+	data := patternData(4096, 5)
+	// The flat data starts 2 sectors into the extent file.
+	flat := append(make([]byte, 2*vmdk.Sector), data...)
+	descriptor := `# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="monolithicFlat"
+
+# Extent description
+RW 8 FLAT "disk-flat.vmdk" 2
+`
+	dd, err := vmdk.ParseTextDiskDescriptor(strings.NewReader(descriptor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := vmdk.OpenExtents(dd, vmdk.MapOpener(map[string][]byte{"disk-flat.vmdk": flat}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.Size() != int64(len(data)) {
+		t.Fatalf("Size() = %d, want %d", sr.Size(), len(data))
+	}
+	got, err := io.ReadAll(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("ReadAll() content mismatch")
+	}
+}
+
+func TestOpenTextDescriptor(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	sparse := patternData(grain, 1)
+	flat := patternData(1024, 2)
+	files := map[string][]byte{
+		"disk-s001.vmdk": buildMonolithicSparse(t, sparse, "disk-s001.vmdk"),
+		"disk-f002.vmdk": flat,
+	}
+	descriptor := `# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="custom"
+
+# Extent description
+RW 128 SPARSE "disk-s001.vmdk"
+RW 2 FLAT "disk-f002.vmdk" 0
+`
+
+	t.Run("happy path", func(t *testing.T) {
+		sr, err := vmdk.OpenWithOpener(strings.NewReader(descriptor), vmdk.MapOpener(files), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, append(append([]byte{}, sparse...), flat...)) {
+			t.Error("ReadAll() content mismatch")
+		}
+	})
+
+	t.Run("sad path, no extent opener", func(t *testing.T) {
+		_, err := vmdk.Open(strings.NewReader(descriptor), nil)
+		if !errors.Is(err, vmdk.ErrNoExtentOpener) {
+			t.Errorf("Open() err = %v, want %v", err, vmdk.ErrNoExtentOpener)
+		}
+	})
+
+	t.Run("sad path, not vmdk", func(t *testing.T) {
+		_, err := vmdk.Open(strings.NewReader("not a vmdk file at all"), nil)
+		if !errors.Is(err, vmdk.ErrIsNotVMDK) {
+			t.Errorf("Open() err = %v, want %v", err, vmdk.ErrIsNotVMDK)
+		}
+	})
+}
+
+func TestReadDiskDescriptor(t *testing.T) {
+	f, err := os.Open("testdata/vmdk-monolith.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	header, err := vmdk.ParseHeader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := vmdk.ParseDiskDescriptor(f, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	embedded, err := vmdk.ReadDiskDescriptor(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(embedded, want) {
+		t.Errorf("ReadDiskDescriptor() embedded got = %v, want %v", embedded, want)
+	}
+
+	var text strings.Builder
+	text.WriteString("# Disk DescriptorFile\nversion=1\nCID=ba26f75f\nparentCID=ffffffff\ncreateType=\"monolithicSparse\"\n")
+	text.WriteString("# Extent description\nRW 128 SPARSE \"vmdk-monolith.img\"\n")
+	text.WriteString("# The Disk Data Base\n#DDB\n\nddb.virtualHWVersion = \"4\"\nddb.geometry.cylinders = \"0\"\n")
+	text.WriteString("ddb.geometry.heads = \"16\"\nddb.geometry.sectors = \"63\"\nddb.adapterType = \"ide\"\nddb.toolsVersion = \"2147483647\"\n")
+	standalone, err := vmdk.ReadDiskDescriptor(strings.NewReader(text.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(standalone, want) {
+		t.Errorf("ReadDiskDescriptor() standalone got = %v, want %v", standalone, want)
+	}
+}
+
+func TestParseDiskDataBase(t *testing.T) {
+	descriptor := `# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="monolithicFlat"
+
+# Extent description
+RW 2048 FLAT "disk-flat.vmdk" 0
+
+# The Disk Data Base
+#DDB
+
+ddb.adapterType = "lsilogic"
+ddb.geometry.cylinders = "1024"
+ddb.geometry.heads = "255"
+ddb.geometry.sectors = "63"
+ddb.longContentID = "1c5bd9d2bd4e8b5c1f2c3f40fffffffe"
+ddb.thinProvisioned = "1"
+ddb.toolsVersion = "10346"
+ddb.uuid = "60 00 C2 9b 6c 5e 5e 1b-8f 9e 65 3b 4e 0c 2b 1d"
+ddb.virtualHWVersion = "14"
+`
+	got, err := vmdk.ParseTextDiskDescriptor(strings.NewReader(descriptor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := vmdk.DiskDataBase{
+		AdapterType:      "lsilogic",
+		VirtualHWVersion: 14,
+		UUID:             "60 00 C2 9b 6c 5e 5e 1b-8f 9e 65 3b 4e 0c 2b 1d",
+		LongContentID:    "1c5bd9d2bd4e8b5c1f2c3f40fffffffe",
+		ToolsVersion:     "10346",
+		Geometry:         vmdk.Geometry{Cylinders: 1024, Heads: 255, Sectors: 63},
+		Extra:            map[string]string{"ddb.thinProvisioned": "1"},
+	}
+	if !reflect.DeepEqual(got.DDB, want) {
+		t.Errorf("ParseTextDiskDescriptor() DDB got = %v, want %v", got.DDB, want)
+	}
+
+	// Values that do not parse are kept in Extra instead of failing.
+	descriptor = strings.NewReplacer(`"14"`, `"vmx-14"`, `heads = "255"`, `heads = "99999999999999999999"`, `"lsilogic"`, `"lsilogic"
+ddb.malformed`).Replace(descriptor)
+	got, err = vmdk.ParseTextDiskDescriptor(strings.NewReader(descriptor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.VirtualHWVersion = 0
+	want.Geometry.Heads = 0
+	want.Extra = map[string]string{
+		"ddb.thinProvisioned":  "1",
+		"ddb.virtualHWVersion": "vmx-14",
+		"ddb.geometry.heads":   "99999999999999999999",
+	}
+	if !reflect.DeepEqual(got.DDB, want) {
+		t.Errorf("ParseTextDiskDescriptor() DDB got = %v, want %v", got.DDB, want)
+	}
+}
+
+func TestOpenDeltaDisk(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	base := patternData(3*grain, 1)
+	parent := buildMonolithicSparse(t, base, "parent.vmdk", "CID=0000000a")
+
+	// The child only overrides the second grain.
+	delta := make([]byte, 3*grain)
+	copy(delta[grain:], patternData(grain, 9))
+	childLines := []string{"CID=0000000b", "parentCID=0000000a", `parentFileNameHint="parent.vmdk"`}
+	child := buildMonolithicSparse(t, delta, "child.vmdk", childLines...)
+
+	want := append([]byte{}, base...)
+	copy(want[grain:], delta[grain:2*grain])
+
+	t.Run("happy path", func(t *testing.T) {
+		open := vmdk.MapOpener(map[string][]byte{"parent.vmdk": parent})
+		sr, err := vmdk.OpenWithOpener(bytes.NewReader(child), open, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Error("ReadAll() content mismatch")
+		}
+	})
+
+	t.Run("happy path, two levels", func(t *testing.T) {
+		grandchildLines := []string{"CID=0000000c", "parentCID=0000000b", `parentFileNameHint="child.vmdk"`}
+		grandchild := buildMonolithicSparse(t, make([]byte, 3*grain), "grandchild.vmdk", grandchildLines...)
+		open := vmdk.MapOpener(map[string][]byte{"parent.vmdk": parent, "child.vmdk": child})
+		sr, err := vmdk.OpenWithOpener(bytes.NewReader(grandchild), open, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Error("ReadAll() content mismatch")
+		}
+	})
+
+	t.Run("sad path, parentCID mismatch", func(t *testing.T) {
+		other := buildMonolithicSparse(t, base, "parent.vmdk", "CID=0000000f")
+		open := vmdk.MapOpener(map[string][]byte{"parent.vmdk": other})
+		_, err := vmdk.OpenWithOpener(bytes.NewReader(child), open, nil)
+		if !errors.Is(err, vmdk.ErrBrokenChain) {
+			t.Errorf("OpenWithOpener() err = %v, want %v", err, vmdk.ErrBrokenChain)
+		}
+	})
+
+	t.Run("sad path, missing parent", func(t *testing.T) {
+		_, err := vmdk.OpenWithOpener(bytes.NewReader(child), vmdk.MapOpener(nil), nil)
+		if !errors.Is(err, vmdk.ErrBrokenChain) {
+			t.Errorf("OpenWithOpener() err = %v, want %v", err, vmdk.ErrBrokenChain)
+		}
+	})
+
+	t.Run("sad path, parent loop", func(t *testing.T) {
+		loopLines := []string{"CID=0000000a", "parentCID=0000000a", `parentFileNameHint="loop.vmdk"`}
+		loop := buildMonolithicSparse(t, delta, "loop.vmdk", loopLines...)
+		open := vmdk.MapOpener(map[string][]byte{"loop.vmdk": loop})
+		_, err := vmdk.OpenWithOpener(bytes.NewReader(loop), open, nil)
+		if !errors.Is(err, vmdk.ErrBrokenChain) {
+			t.Errorf("OpenWithOpener() err = %v, want %v", err, vmdk.ErrBrokenChain)
+		}
+	})
+}
+
+func TestOpenZeroExtent(t *testing.T) {
+	flat := patternData(1024, 4)
+	descriptor := `# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="custom"
+
+# Extent description
+RW 2 FLAT "disk-flat.vmdk" 0
+RW 4 ZERO
+RW 2 FLAT "disk-flat.vmdk" 0
+`
+	dd, err := vmdk.ParseTextDiskDescriptor(strings.NewReader(descriptor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (vmdk.ExtentDescription{Mode: "RW", Size: 4, Type: "ZERO"}); !reflect.DeepEqual(dd.Extents[1], want) {
+		t.Errorf("ParseTextDiskDescriptor() extent got = %v, want %v", dd.Extents[1], want)
+	}
+
+	sr, err := vmdk.OpenWithOpener(strings.NewReader(descriptor), vmdk.MapOpener(map[string][]byte{"disk-flat.vmdk": flat}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append(append([]byte{}, flat...), make([]byte, 4*vmdk.Sector)...), flat...)
+	if !bytes.Equal(got, want) {
+		t.Error("ReadAll() content mismatch")
+	}
+}
+
+func TestStreamOptimizedWriter(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	// Cross a grain table boundary (512 grains) and end with a partial grain.
+	data := make([]byte, 513*grain+4*int(vmdk.Sector))
+	copy(data[grain:], patternData(grain, 1))
+	copy(data[512*grain+100:], patternData(grain, 2))
+	copy(data[len(data)-int(vmdk.Sector):], patternData(int(vmdk.Sector), 3))
+
+	var buf bytes.Buffer
+	if err := vmdk.WriteStreamOptimized(&buf, bytes.NewReader(data), int64(len(data)), "disk.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() >= len(data)/8 {
+		t.Errorf("image size = %d, want compressed and sparse output", buf.Len())
+	}
+
+	dd, err := vmdk.ReadDiskDescriptor(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dd.CreateType != vmdk.StreamOptimized || dd.Extents[0].Size != int64(len(data))/vmdk.Sector {
+		t.Errorf("ReadDiskDescriptor() got = %v", dd)
+	}
+
+	sr, err := vmdk.Open(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("ReadAll() content mismatch")
+	}
+
+	// Each image gets its own CID, as delta disks are linked by it.
+	var other bytes.Buffer
+	if err := vmdk.WriteStreamOptimized(&other, bytes.NewReader(data), int64(len(data)), "disk.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+	otherDD, err := vmdk.ReadDiskDescriptor(bytes.NewReader(other.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dd.CID) != 8 || dd.CID == otherDD.CID {
+		t.Errorf("CIDs = %q and %q, want two distinct 8-digit CIDs", dd.CID, otherDD.CID)
+	}
+}
+
+func TestStreamOptimizedWriterExceedCapacity(t *testing.T) {
+	w, err := vmdk.NewStreamOptimizedWriter(io.Discard, 1024, "disk.vmdk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := w.Write(make([]byte, 1536))
+	if !errors.Is(err, vmdk.ErrExceedCapacity) || n != 1024 {
+		t.Errorf("Write() = %d, %v, want 1024, %v", n, err, vmdk.ErrExceedCapacity)
+	}
+}
+
+// memFile is an in-memory io.WriterAt and io.ReaderAt.
+type memFile struct {
+	b []byte
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(f.b)) {
+		f.b = append(f.b, make([]byte, end-int64(len(f.b)))...)
+	}
+	return copy(f.b[off:], p), nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(f.b).ReadAt(p, off)
+}
+
+func (f *memFile) Size() int64 {
+	return int64(len(f.b))
+}
+
+func TestMonolithicSparseWriter(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	data := make([]byte, 513*grain+4*int(vmdk.Sector))
+	copy(data[grain:], patternData(grain, 1))
+	copy(data[512*grain+100:], patternData(grain, 2))
+	copy(data[len(data)-int(vmdk.Sector):], patternData(int(vmdk.Sector), 3))
+
+	var f memFile
+	if err := vmdk.WriteMonolithicSparse(&f, bytes.NewReader(data), int64(len(data)), "disk.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := vmdk.ParseHeader(bytes.NewReader(f.b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the 3 non-zero grains are allocated.
+	if want := header.OverHead*vmdk.Sector + 3*int64(grain); int64(len(f.b)) != want {
+		t.Errorf("image size = %d, want %d", len(f.b), want)
+	}
+	if header.RgdOffset == 0 || uint32(header.Flag)&vmdk.FlagUseRedundantGrainTable == 0 {
+		t.Errorf("header has no redundant grain directory: %+v", header)
+	}
+
+	sr, err := vmdk.Open(bytes.NewReader(f.b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("ReadAll() content mismatch")
+	}
+}
+
+// readGrainTables returns the grain tables linked from the grain directory at gdOffset.
+func readGrainTables(t *testing.T, image []byte, header vmdk.Header, gdOffset int64) [][]uint32 {
+	t.Helper()
+	numGrains := (header.Capacity + header.GrainSize - 1) / header.GrainSize
+	numGTs := (numGrains + int64(header.NumGTEsPerGT) - 1) / int64(header.NumGTEsPerGT)
+	var gts [][]uint32
+	for i := int64(0); i < numGTs; i++ {
+		gtOffset := int64(binary.LittleEndian.Uint32(image[gdOffset*vmdk.Sector+i*4:]))
+		gt := make([]uint32, header.NumGTEsPerGT)
+		for j := range gt {
+			gt[j] = binary.LittleEndian.Uint32(image[gtOffset*vmdk.Sector+int64(j)*4:])
+		}
+		gts = append(gts, gt)
+	}
+	return gts
+}
+
+func TestOpenWritable(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	data := make([]byte, 1025*grain)
+	copy(data[grain:], patternData(grain, 1))
+
+	path := filepath.Join(t.TempDir(), "disk.vmdk")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := vmdk.WriteMonolithicSparse(f, bytes.NewReader(data), int64(len(data)), "disk.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unlink the empty last grain table, so that writing there allocates one.
+	header, err := vmdk.ParseHeader(io.NewSectionReader(f, 0, vmdk.Sector))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, gdOffset := range []int64{header.GdOffset, header.RgdOffset} {
+		if _, err := f.WriteAt(make([]byte, 4), gdOffset*vmdk.Sector+2*4); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	img, err := vmdk.OpenWritable(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := []struct {
+		off  int64
+		data []byte
+	}{
+		// Into an allocated grain.
+		{int64(grain) + 100, patternData(300, 5)},
+		// Across an allocated and an unallocated grain.
+		{2*int64(grain) - 512, patternData(1024, 6)},
+		// Into the last, unallocated grain table.
+		{1024*int64(grain) + 7, patternData(2000, 7)},
+		// Zeros into a sparse region do not allocate.
+		{600 * int64(grain), make([]byte, grain)},
+		// Into the grain table allocated past the original end of the file.
+		{1024*int64(grain) + 5000, patternData(700, 8)},
+	}
+	for _, w := range writes {
+		if _, err := img.WriteAt(w.data, w.off); err != nil {
+			t.Fatal(err)
+		}
+		copy(data[w.off:], w.data)
+	}
+
+	// The written data reads back before Close.
+	got, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("ReadAt() content mismatch while writing")
+	}
+
+	header, err = vmdk.ParseHeader(io.NewSectionReader(f, 0, vmdk.Sector))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.UncleanShutdown != 1 {
+		t.Errorf("UncleanShutdown = %d while writing, want 1", header.UncleanShutdown)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err = vmdk.ParseHeader(bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.UncleanShutdown != 0 {
+		t.Errorf("UncleanShutdown = %d after Close, want 0", header.UncleanShutdown)
+	}
+	if !reflect.DeepEqual(readGrainTables(t, image, header, header.GdOffset), readGrainTables(t, image, header, header.RgdOffset)) {
+		t.Error("grain tables and redundant grain tables differ")
+	}
+	// 3 grains and a grain table with its redundant copy are allocated.
+	if want := header.OverHead*vmdk.Sector + 3*int64(grain) + 2*4*vmdk.Sector; int64(len(image)) != want {
+		t.Errorf("image size = %d, want %d", len(image), want)
+	}
+
+	sr, err := vmdk.Open(bytes.NewReader(image), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = io.ReadAll(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("ReadAll() content mismatch")
+	}
+
+	// A grain table only in one of the directories is refused, as it could not
+	// be updated in both.
+	if _, err := f.WriteAt(make([]byte, 4), header.RgdOffset*vmdk.Sector); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vmdk.OpenWritable(f, nil); !errors.Is(err, vmdk.ErrGrainDirectoryMismatch) {
+		t.Errorf("OpenWritable() error = %v, want %v", err, vmdk.ErrGrainDirectoryMismatch)
+	}
+}
+
+func TestOpenWritableConcurrentReads(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	data := patternData(2*grain, 1)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "disk.vmdk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := vmdk.WriteMonolithicSparse(f, bytes.NewReader(data), int64(len(data)), "disk.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+	img, err := vmdk.OpenWritable(f, vmdk.NewLRUCache(int64(4*grain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers filling the cache while the grain is rewritten must not leave
+	// an old copy of it cached.
+	var last []byte
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, grain)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := img.ReadAt(buf, int64(grain)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		last = patternData(grain, byte(i+2))
+		if _, err := img.WriteAt(last, int64(grain)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	got := make([]byte, grain)
+	if _, err := img.ReadAt(got, int64(grain)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, last) {
+		t.Error("ReadAt() returned a stale grain after the last write")
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readSeeker hides the io.ReaderAt of the underlying reader.
+type readSeeker struct {
+	io.ReadSeeker
+}
+
+func TestConcurrentReadAt(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	data := make([]byte, 600*grain)
+	for i := 0; i < 600; i += 3 {
+		copy(data[i*grain:], patternData(grain, byte(i)))
+	}
+
+	var streamOptimized bytes.Buffer
+	if err := vmdk.WriteStreamOptimized(&streamOptimized, bytes.NewReader(data), int64(len(data)), "disk.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+	monolithicSparse := buildMonolithicSparse(t, data, "disk.vmdk")
+
+	tests := []struct {
+		name string
+		rs   io.ReadSeeker
+		opts []vmdk.Option
+	}{
+		{"streamOptimized", bytes.NewReader(streamOptimized.Bytes()), nil},
+		{"streamOptimized with read-ahead", bytes.NewReader(streamOptimized.Bytes()), []vmdk.Option{vmdk.WithReadAhead(4, 2)}},
+		{"monolithicSparse", bytes.NewReader(monolithicSparse), nil},
+		{"without ReaderAt", readSeeker{bytes.NewReader(monolithicSparse)}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sr, err := vmdk.Open(tt.rs, nil, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 8)
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					buf := make([]byte, grain+1000)
+					for i := g; i < len(data)/grain-1; i += 8 {
+						off := int64(i*grain + 500)
+						if _, err := sr.ReadAt(buf, off); err != nil {
+							errs <- err
+							return
+						}
+						if !bytes.Equal(buf, data[off:off+int64(len(buf))]) {
+							errs <- fmt.Errorf("content mismatch at %d", off)
+							return
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// readerAt hides every method of the underlying reader but ReadAt.
+type readerAt struct {
+	r io.ReaderAt
+}
+
+func (r readerAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.r.ReadAt(p, off)
+}
+
+func TestOpenReaderAt(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	data := make([]byte, 4*grain)
+	copy(data[grain:], patternData(2*grain, 3))
+
+	var streamOptimized bytes.Buffer
+	if err := vmdk.WriteStreamOptimized(&streamOptimized, bytes.NewReader(data), int64(len(data)), "disk.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		image []byte
+		open  vmdk.ExtentOpener
+	}{
+		{"monolithicSparse", buildMonolithicSparse(t, data, "disk.vmdk"), nil},
+		{"streamOptimized", streamOptimized.Bytes(), nil},
+		{
+			"text descriptor",
+			[]byte("# Disk DescriptorFile\nCID=fffffffe\nparentCID=ffffffff\ncreateType=\"monolithicFlat\"\n# Extent description\nRW 512 FLAT \"disk-flat.vmdk\" 0\n"),
+			vmdk.MapOpener(map[string][]byte{"disk-flat.vmdk": data}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sr, err := vmdk.OpenReaderAt(readerAt{bytes.NewReader(tt.image)}, int64(len(tt.image)), tt.open, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(sr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("ReadAll() content mismatch")
+			}
+		})
+	}
+
+	// Open leaves the offset of the caller's reader where it was.
+	rs := bytes.NewReader(streamOptimized.Bytes())
+	if _, err := rs.Seek(100, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vmdk.Open(rs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if pos, _ := rs.Seek(0, io.SeekCurrent); pos != 100 {
+		t.Errorf("offset after Open() = %d, want 100", pos)
+	}
+}
+
+// countingReaderAt counts the reads at each offset.
+type countingReaderAt struct {
+	r io.ReaderAt
+
+	mu     sync.Mutex
+	counts map[int64]int
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	r.counts[off]++
+	r.mu.Unlock()
+	return r.r.ReadAt(p, off)
+}
+
+func (r *countingReaderAt) reset() {
+	r.mu.Lock()
+	r.counts = make(map[int64]int)
+	r.mu.Unlock()
+}
+
+func (r *countingReaderAt) reads() map[int64]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counts
+}
+
+func TestReadAhead(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	data := make([]byte, 40*grain)
+	for i := 0; i < 40; i++ {
+		// Leave some grains unallocated.
+		if i%5 != 4 {
+			copy(data[i*grain:], patternData(grain, byte(i)))
+		}
+	}
+	var image bytes.Buffer
+	if err := vmdk.WriteStreamOptimized(&image, bytes.NewReader(data), int64(len(data)), "disk.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		bufSize int
+		window  int
+		workers int
+	}{
+		{"small reads", 4096, 8, 4},
+		{"grain reads", grain, 3, 0},
+		{"large reads", 3*grain + 100, 16, 2},
+		{"disabled", grain, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &countingReaderAt{r: bytes.NewReader(image.Bytes()), counts: make(map[int64]int)}
+			sr, err := vmdk.OpenReaderAt(r, int64(image.Len()), nil, nil, vmdk.WithReadAhead(tt.window, tt.workers))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.reset()
+			var got bytes.Buffer
+			if _, err := io.CopyBuffer(struct{ io.Writer }{&got}, struct{ io.Reader }{sr}, make([]byte, tt.bufSize)); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), data) {
+				t.Error("sequential read content mismatch")
+			}
+			// Without a cache, each grain is read once only if the reads inside
+			// it use the prefetched grain.
+			if tt.window > 0 {
+				for off, n := range r.reads() {
+					if n > 1 {
+						t.Errorf("offset %d is read %d times", off, n)
+					}
+				}
+			}
+
+			// Random reads after a sequential scan.
+			buf := make([]byte, 1000)
+			for _, off := range []int64{int64(30*grain) + 5, 100, int64(7*grain) - 500} {
+				if _, err := sr.ReadAt(buf, off); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(buf, data[off:off+int64(len(buf))]) {
+					t.Errorf("ReadAt(%d) content mismatch", off)
+				}
+			}
+		})
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	key := func(offset int64) vmdk.CacheKey { return vmdk.CacheKey{Namespace: "disk", Offset: offset} }
+	a, b, c, d := key(1), key(2), key(3), key(4)
+	cache := vmdk.NewLRUCache(10)
+	if evicted := cache.Add(a, make([]byte, 4)); evicted {
+		t.Error("Add(a) evicted an entry")
+	}
+	cache.Add(b, make([]byte, 4))
+	// a becomes the most recently used.
+	if _, ok := cache.Get(a); !ok {
+		t.Fatal("Get(a) missed")
+	}
+	if evicted := cache.Add(c, make([]byte, 4)); !evicted {
+		t.Error("Add(c) did not evict an entry")
+	}
+	if _, ok := cache.Get(b); ok {
+		t.Error("b is not evicted")
+	}
+	for _, k := range []vmdk.CacheKey{a, c} {
+		if _, ok := cache.Get(k); !ok {
+			t.Errorf("Get(%+v) missed", k)
+		}
+	}
+	if _, ok := cache.Get(vmdk.CacheKey{Namespace: "other", Offset: 1}); ok {
+		t.Error("Get() hit a key of another namespace")
+	}
+	if cache.Len() != 2 || cache.Size() != 8 {
+		t.Errorf("Len() = %d, Size() = %d, want 2, 8", cache.Len(), cache.Size())
+	}
+
+	// Replacing an entry updates the size.
+	cache.Add(a, make([]byte, 2))
+	if cache.Size() != 6 {
+		t.Errorf("Size() = %d after replacing, want 6", cache.Size())
+	}
+	// Values over the budget are not cached.
+	cache.Add(d, make([]byte, 11))
+	if _, ok := cache.Get(d); ok {
+		t.Error("value over the budget is cached")
+	}
+}
+
+func TestOpenWithLRUCache(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	data := make([]byte, 8*grain)
+	for i := 0; i < 8; i++ {
+		copy(data[i*grain:], patternData(grain, byte(i)))
+	}
+	var image bytes.Buffer
+	if err := vmdk.WriteStreamOptimized(&image, bytes.NewReader(data), int64(len(data)), "disk.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := vmdk.NewLRUCache(int64(3 * grain))
+	sr, err := vmdk.Open(bytes.NewReader(image.Bytes()), cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		got, err := io.ReadAll(io.NewSectionReader(sr, 0, sr.Size()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("ReadAll() content mismatch")
+		}
+	}
+	if cache.Len() != 3 || cache.Size() != int64(3*grain) {
+		t.Errorf("Len() = %d, Size() = %d, want 3, %d", cache.Len(), cache.Size(), 3*grain)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestGrainTableCache(t *testing.T) {
+	// A grain in each of 3 grain tables.
+	grain := 128 * vmdk.Sector
+	gtSize := 512 * grain
+	var readers []io.Reader
+	for i := 0; i < 3; i++ {
+		readers = append(readers, bytes.NewReader(patternData(int(grain), byte(i))), io.LimitReader(zeroReader{}, gtSize-grain))
+	}
+	var image bytes.Buffer
+	if err := vmdk.WriteStreamOptimized(&image, io.MultiReader(readers...), 3*gtSize, "disk.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+	// Room for a single grain table.
+	cache := vmdk.NewGrainTableCache(512 * 4)
+	sr, err := vmdk.Open(bytes.NewReader(image.Bytes()), nil, vmdk.WithGrainTableCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	for _, gt := range []int64{0, 0, 1, 0, 2, 2} {
+		if _, err := sr.ReadAt(buf, gt*gtSize); err != nil {
+			t.Fatal(err)
+		}
+		if want := patternData(int(grain), byte(gt))[:len(buf)]; !bytes.Equal(buf, want) {
+			t.Errorf("grain table %d: content mismatch", gt)
+		}
+	}
+	want := vmdk.CacheStats{Hits: 2, Misses: 4, Evictions: 3}
+	if got := cache.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+	if cache.Len() != 1 {
+		t.Errorf("Len() = %d, want 1", cache.Len())
+	}
+}
+
+func TestSharedCache(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	data1 := patternData(4*grain, 1)
+	data2 := patternData(4*grain, 2)
+	// Both images have their grains at the same offsets.
+	image1 := buildMonolithicSparse(t, data1, "disk1.vmdk")
+	image2 := buildMonolithicSparse(t, data2, "disk1.vmdk")
+
+	cache := vmdk.NewLRUCache(int64(32 * grain))
+	for i := 0; i < 2; i++ {
+		for _, tt := range []struct {
+			image, data []byte
+		}{{image1, data1}, {image2, data2}} {
+			sr, err := vmdk.Open(bytes.NewReader(tt.image), cache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(sr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Error("ReadAll() content mismatch")
+			}
+		}
+	}
+	// Every open has its own namespace by default, so each grain is loaded
+	// once per open.
+	if misses := cache.Stats().Misses; misses != 16 {
+		t.Errorf("Misses = %d, want 16", misses)
+	}
+
+	// Reopening with the same namespace reuses the cached grains.
+	for i := 0; i < 2; i++ {
+		sr, err := vmdk.Open(bytes.NewReader(image1), cache, vmdk.WithNamespace("disk1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data1) {
+			t.Error("ReadAll() content mismatch")
+		}
+	}
+	if misses := cache.Stats().Misses; misses != 20 {
+		t.Errorf("Misses = %d, want 20", misses)
+	}
+}
+
+func TestCacheNamespaces(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	split := func(extent string, data []byte) ([]byte, vmdk.ExtentOpener) {
+		descriptor := "# Disk DescriptorFile\nCID=fffffffe\nparentCID=ffffffff\ncreateType=\"twoGbMaxExtentSparse\"\n" +
+			"# Extent description\nRW " + strconv.Itoa(len(data)/int(vmdk.Sector)) + " SPARSE \"" + extent + "\"\n"
+		files := map[string][]byte{extent: buildMonolithicSparse(t, data, extent)}
+		return []byte(descriptor), vmdk.MapOpener(files)
+	}
+
+	// "disk" with extent "x:y" and "disk:x" with extent "y" must not share
+	// cached grains.
+	cache := vmdk.NewLRUCache(1 << 20)
+	tests := []struct {
+		namespace string
+		extent    string
+		data      []byte
+	}{
+		{"disk", "x:y", patternData(grain, 1)},
+		{"disk:x", "y", patternData(grain, 2)},
+	}
+	for _, tt := range tests {
+		descriptor, open := split(tt.extent, tt.data)
+		d, err := vmdk.OpenWithOpener(bytes.NewReader(descriptor), open, cache, vmdk.WithNamespace(tt.namespace))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tt.data) {
+			t.Errorf("ReadAll() of %q content mismatch", tt.namespace)
+		}
+	}
+}
+
+func collectRanges(t *testing.T, d *vmdk.Disk) []vmdk.Range {
+	t.Helper()
+	var ranges []vmdk.Range
+	if err := d.WalkRanges(func(r vmdk.Range) error {
+		ranges = append(ranges, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return ranges
+}
+
+// buildSparseLayout returns a monolithicSparse image of 8 grains, of which
+// grains 1, 2 and 5 are allocated and grain 6 is zeroed, and its content.
+func buildSparseLayout(t *testing.T) (image, data []byte) {
+	t.Helper()
+	grain := 128 * vmdk.Sector
+	data = make([]byte, 8*grain)
+	for _, i := range []int64{1, 2, 5} {
+		copy(data[i*grain:], patternData(int(grain), byte(i)))
+	}
+
+	image = buildMonolithicSparse(t, data, "disk.vmdk")
+	binary.LittleEndian.PutUint32(image[8:], 3|vmdk.FlagUseZeroedGrainTableEntry)
+	gtOffset := int64(binary.LittleEndian.Uint32(image[2*vmdk.Sector:]))
+	binary.LittleEndian.PutUint32(image[gtOffset*vmdk.Sector+6*4:], uint32(vmdk.GTEZeroed))
+	return image, data
+}
+
+func TestWalkRanges(t *testing.T) {
+	grain := 128 * vmdk.Sector
+	g := func(off, n int64, state vmdk.RangeState) vmdk.Range {
+		return vmdk.Range{Offset: off * grain, Length: n * grain, State: state}
+	}
+	monolithicSparse, data := buildSparseLayout(t)
+
+	var streamOptimized bytes.Buffer
+	if err := vmdk.WriteStreamOptimized(&streamOptimized, bytes.NewReader(data), int64(len(data)), "disk.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A 2 TiB disk whose grain tables are all unallocated but the first one.
+	const large = 2 << 40
+	var largeDisk bytes.Buffer
+	sw, err := vmdk.NewStreamOptimizedWriter(&largeDisk, large, "large.vmdk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sw.Write(patternData(int(grain), 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	parent := buildMonolithicSparse(t, data[:4*grain], "parent.vmdk", "CID=0000000a")
+	delta := make([]byte, 8*grain)
+	copy(delta[3*grain:], patternData(int(grain), 3))
+	child := buildMonolithicSparse(t, delta, "child.vmdk", "CID=0000000b", "parentCID=0000000a", `parentFileNameHint="parent.vmdk"`)
+
+	descriptor := "# Disk DescriptorFile\nCID=fffffffe\nparentCID=ffffffff\ncreateType=\"twoGbMaxExtentSparse\"\n" +
+		"# Extent description\nRW 256 FLAT \"disk-flat.vmdk\" 0\nRW 256 ZERO\nRW 1024 SPARSE \"disk-s001.vmdk\"\n"
+	files := map[string][]byte{
+		"disk-flat.vmdk": make([]byte, 2*grain),
+		"disk-s001.vmdk": monolithicSparse,
+		"parent.vmdk":    parent,
+	}
+
+	tests := []struct {
+		name  string
+		image []byte
+		want  []vmdk.Range
+	}{
+		{
+			name:  "monolithicSparse",
+			image: monolithicSparse,
+			want: []vmdk.Range{
+				g(0, 1, vmdk.RangeUnallocated),
+				g(1, 2, vmdk.RangeAllocated),
+				g(3, 2, vmdk.RangeUnallocated),
+				g(5, 1, vmdk.RangeAllocated),
+				g(6, 1, vmdk.RangeZeroed),
+				g(7, 1, vmdk.RangeUnallocated),
+			},
+		},
+		{
+			name:  "streamOptimized",
+			image: streamOptimized.Bytes(),
+			want: []vmdk.Range{
+				g(0, 1, vmdk.RangeUnallocated),
+				g(1, 2, vmdk.RangeAllocated),
+				g(3, 2, vmdk.RangeUnallocated),
+				g(5, 1, vmdk.RangeAllocated),
+				g(6, 2, vmdk.RangeUnallocated),
+			},
+		},
+		{
+			name:  "extents",
+			image: []byte(descriptor),
+			want: []vmdk.Range{
+				g(0, 2, vmdk.RangeAllocated),
+				g(2, 2, vmdk.RangeZeroed),
+				g(4, 1, vmdk.RangeUnallocated),
+				g(5, 2, vmdk.RangeAllocated),
+				g(7, 2, vmdk.RangeUnallocated),
+				g(9, 1, vmdk.RangeAllocated),
+				g(10, 1, vmdk.RangeZeroed),
+				g(11, 1, vmdk.RangeUnallocated),
+			},
+		},
+		{
+			name:  "large disk",
+			image: largeDisk.Bytes(),
+			want: []vmdk.Range{
+				g(0, 1, vmdk.RangeAllocated),
+				{Offset: grain, Length: large - grain, State: vmdk.RangeUnallocated},
+			},
+		},
+		{
+			// The parent covers the first 4 grains only.
+			name:  "delta disk",
+			image: child,
+			want: []vmdk.Range{
+				g(0, 1, vmdk.RangeUnallocated),
+				g(1, 3, vmdk.RangeAllocated),
+				g(4, 4, vmdk.RangeUnallocated),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := vmdk.OpenWithOpener(bytes.NewReader(tt.image), vmdk.MapOpener(files), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := collectRanges(t, d); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("WalkRanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("stop", func(t *testing.T) {
+		d, err := vmdk.Open(bytes.NewReader(monolithicSparse), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errStop := errors.New("stop")
+		calls := 0
+		err = d.WalkRanges(func(r vmdk.Range) error {
+			calls++
+			if r.State == vmdk.RangeAllocated {
+				return errStop
+			}
+			return nil
+		})
+		if err != errStop || calls != 2 {
+			t.Errorf("WalkRanges() = %v after %d calls, want %v after 2 calls", err, calls, errStop)
+		}
+	})
+}
+
+func TestSeekDataHole(t *testing.T) {
+	grain := 128 * vmdk.Sector
+	image, data := buildSparseLayout(t)
+	d, err := vmdk.Open(bytes.NewReader(image), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		seek    func(int64) (int64, error)
+		off     int64
+		want    int64
+		wantErr error
+	}{
+		{"data in hole", d.SeekData, 0, grain, nil},
+		{"data in data", d.SeekData, grain + 5, grain + 5, nil},
+		{"data after hole", d.SeekData, 3 * grain, 5 * grain, nil},
+		{"data in zeroed", d.SeekData, 6 * grain, 0, vmdk.ErrNoData},
+		{"data at end", d.SeekData, 8 * grain, 0, vmdk.ErrNoData},
+		{"hole in hole", d.SeekHole, 7, 7, nil},
+		{"hole in data", d.SeekHole, grain, 3 * grain, nil},
+		{"hole is zeroed", d.SeekHole, 5*grain + 1, 6 * grain, nil},
+		{"hole at end", d.SeekHole, 8 * grain, 0, vmdk.ErrNoData},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.seek(tt.off)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("Seek", func(t *testing.T) {
+		pos, err := d.Seek(3*grain, vmdk.SeekData)
+		if err != nil || pos != 5*grain {
+			t.Fatalf("Seek() = %d, %v, want %d", pos, err, 5*grain)
+		}
+		buf := make([]byte, 100)
+		if _, err := io.ReadFull(d, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data[5*grain:5*grain+100]) {
+			t.Error("Read() after Seek() content mismatch")
+		}
+		if pos, err := d.Seek(0, io.SeekCurrent); err != nil || pos != 5*grain+100 {
+			t.Errorf("Seek(0, io.SeekCurrent) = %d, %v, want %d", pos, err, 5*grain+100)
+		}
+	})
+
+	t.Run("no hole", func(t *testing.T) {
+		full := buildMonolithicSparse(t, patternData(int(2*grain), 1), "disk.vmdk")
+		d, err := vmdk.Open(bytes.NewReader(full), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos, err := d.SeekHole(0); err != nil || pos != d.Size() {
+			t.Errorf("SeekHole(0) = %d, %v, want %d", pos, err, d.Size())
+		}
+	})
+}
+
+func TestConvertToRaw(t *testing.T) {
+	image, data := buildSparseLayout(t)
+	d, err := vmdk.Open(bytes.NewReader(image), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "disk.raw")
+	// Existing content is replaced.
+	if err := os.WriteFile(path, bytes.Repeat([]byte{0xff}, 2*len(data)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var last int64
+	err = vmdk.ConvertToRaw(d, f, func(done, total int64) {
+		if done < last || total != d.Size() {
+			t.Errorf("progress(%d, %d) after %d", done, total, last)
+		}
+		last = done
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != d.Size() {
+		t.Errorf("last progress = %d, want %d", last, d.Size())
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("raw image content mismatch")
+	}
+}
+
+func TestConvertSparseFormats(t *testing.T) {
+	grain := 128 * vmdk.Sector
+	image, data := buildSparseLayout(t)
+	allocated := []vmdk.Range{
+		{Offset: 0, Length: grain, State: vmdk.RangeUnallocated},
+		{Offset: grain, Length: 2 * grain, State: vmdk.RangeAllocated},
+		{Offset: 3 * grain, Length: 2 * grain, State: vmdk.RangeUnallocated},
+		{Offset: 5 * grain, Length: grain, State: vmdk.RangeAllocated},
+		{Offset: 6 * grain, Length: 2 * grain, State: vmdk.RangeUnallocated},
+	}
+
+	d, err := vmdk.Open(bytes.NewReader(image), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var streamOptimized bytes.Buffer
+	var last int64
+	err = vmdk.ConvertToStreamOptimized(d, &streamOptimized, "disk.vmdk", func(done, total int64) {
+		if done <= last || total != d.Size() {
+			t.Errorf("progress(%d, %d) after %d", done, total, last)
+		}
+		last = done
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != d.Size() {
+		t.Errorf("last progress = %d, want %d", last, d.Size())
+	}
+
+	so, err := vmdk.Open(bytes.NewReader(streamOptimized.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dd, err := vmdk.ReadDiskDescriptor(bytes.NewReader(streamOptimized.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dd.CreateType != vmdk.StreamOptimized {
+		t.Errorf("createType = %s, want %s", dd.CreateType, vmdk.StreamOptimized)
+	}
+	got, err := io.ReadAll(so)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("streamOptimized content mismatch")
+	}
+	if ranges := collectRanges(t, so); !reflect.DeepEqual(ranges, allocated) {
+		t.Errorf("streamOptimized ranges = %v, want %v", ranges, allocated)
+	}
+
+	// And back.
+	monolithicSparse := &memFile{}
+	if err := vmdk.ConvertToMonolithicSparse(so, monolithicSparse, "disk.vmdk", nil); err != nil {
+		t.Fatal(err)
+	}
+	ms, err := vmdk.Open(bytes.NewReader(monolithicSparse.b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dd, err = vmdk.ReadDiskDescriptor(bytes.NewReader(monolithicSparse.b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dd.CreateType != vmdk.MonolithicSparse {
+		t.Errorf("createType = %s, want %s", dd.CreateType, vmdk.MonolithicSparse)
+	}
+	got, err = io.ReadAll(ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("monolithicSparse content mismatch")
+	}
+	if ranges := collectRanges(t, ms); !reflect.DeepEqual(ranges, allocated) {
+		t.Errorf("monolithicSparse ranges = %v, want %v", ranges, allocated)
+	}
+}
+
+func TestConvertKeepsDiskDataBase(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	image := buildMonolithicSparse(t, patternData(2*grain, 1), "disk.vmdk",
+		"# The Disk Data Base",
+		`ddb.adapterType = "lsilogic"`,
+		`ddb.virtualHWVersion = "14"`,
+		`ddb.uuid = "60 00 C2 9a 5c 6e 1d 3b-8f 2a 1f 40 95 2c 77 01"`,
+		`ddb.longContentID = "0123456789abcdef0123456789abcdef"`,
+		`ddb.toolsVersion = "10346"`,
+		`ddb.geometry.cylinders = "1"`,
+		`ddb.geometry.heads = "255"`,
+		`ddb.geometry.sectors = "63"`,
+		`ddb.thinProvisioned = "1"`,
+	)
+	src, err := vmdk.ReadDiskDescriptor(bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.DDB.AdapterType != "lsilogic" || src.DDB.Extra["ddb.thinProvisioned"] != "1" {
+		t.Fatalf("source DDB = %+v", src.DDB)
+	}
+	d, err := vmdk.Open(bytes.NewReader(image), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var streamOptimized bytes.Buffer
+	if err := vmdk.ConvertToStreamOptimized(d, &streamOptimized, "disk.vmdk", nil); err != nil {
+		t.Fatal(err)
+	}
+	monolithicSparse := &memFile{}
+	if err := vmdk.ConvertToMonolithicSparse(d, monolithicSparse, "disk.vmdk", nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, b := range map[string][]byte{
+		"streamOptimized":  streamOptimized.Bytes(),
+		"monolithicSparse": monolithicSparse.b,
+	} {
+		dd, err := vmdk.ReadDiskDescriptor(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(dd.DDB, src.DDB) {
+			t.Errorf("%s DDB = %+v, want %+v", name, dd.DDB, src.DDB)
+		}
+	}
+}
+
+// entryOffset returns the byte offset of the grain table entry of the index-th
+// grain, in the grain tables linked from the grain directory at gdOffset.
+func entryOffset(image []byte, gdOffset, index int64) int64 {
+	gtOffset := int64(binary.LittleEndian.Uint32(image[gdOffset*vmdk.Sector+index/512*4:]))
+	return gtOffset*vmdk.Sector + index%512*4
+}
+
+func TestVerify(t *testing.T) {
+	_, data := buildSparseLayout(t)
+	var ms memFile
+	if err := vmdk.WriteMonolithicSparse(&ms, bytes.NewReader(data), int64(len(data)), "disk.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+	var so bytes.Buffer
+	if err := vmdk.WriteStreamOptimized(&so, bytes.NewReader(data), int64(len(data)), "disk.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+	header, err := vmdk.ParseHeader(bytes.NewReader(ms.b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	footer, err := vmdk.ParseHeader(bytes.NewReader(so.Bytes()[so.Len()-2*int(vmdk.Sector):]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// setEntry sets the entry of the index-th grain in both grain tables.
+	setEntry := func(image []byte, index int64, e uint32) {
+		for _, gdOffset := range []int64{header.GdOffset, header.RgdOffset} {
+			binary.LittleEndian.PutUint32(image[entryOffset(image, gdOffset, index):], e)
+		}
+	}
+	entry := func(image []byte, gdOffset, index int64) uint32 {
+		return binary.LittleEndian.Uint32(image[entryOffset(image, gdOffset, index):])
+	}
+
+	tests := []struct {
+		name    string
+		image   []byte
+		corrupt func(image []byte) []byte
+		want    []vmdk.FindingKind
+	}{
+		{
+			name:  "monolithicSparse",
+			image: ms.b,
+		},
+		{
+			name:  "unclean shutdown",
+			image: ms.b,
+			corrupt: func(image []byte) []byte {
+				image[72] = 1
+				return image
+			},
+			want: []vmdk.FindingKind{vmdk.FindingUncleanShutdown},
+		},
+		{
+			name:  "redundant grain table mismatch",
+			image: ms.b,
+			corrupt: func(image []byte) []byte {
+				binary.LittleEndian.PutUint32(image[entryOffset(image, header.RgdOffset, 1):], 0)
+				return image
+			},
+			want: []vmdk.FindingKind{vmdk.FindingGrainDirectoryMismatch},
+		},
+		{
+			name:  "grain past EOF",
+			image: ms.b,
+			corrupt: func(image []byte) []byte {
+				// The last grain is orphaned.
+				setEntry(image, 5, uint32(len(image))/uint32(vmdk.Sector))
+				return image
+			},
+			want: []vmdk.FindingKind{vmdk.FindingGrainPastEOF, vmdk.FindingOrphanedData},
+		},
+		{
+			name:  "grain in metadata",
+			image: ms.b,
+			corrupt: func(image []byte) []byte {
+				setEntry(image, 5, uint32(header.GdOffset))
+				return image
+			},
+			want: []vmdk.FindingKind{vmdk.FindingGrainInMetadata, vmdk.FindingOrphanedData},
+		},
+		{
+			name:  "overlapping grains",
+			image: ms.b,
+			corrupt: func(image []byte) []byte {
+				setEntry(image, 5, entry(image, header.GdOffset, 1)+8)
+				return image
+			},
+			want: []vmdk.FindingKind{
+				vmdk.FindingOverlappingGrains, vmdk.FindingOverlappingGrains, vmdk.FindingOrphanedData,
+			},
+		},
+		{
+			name:  "orphaned data",
+			image: ms.b,
+			corrupt: func(image []byte) []byte {
+				return append(image, patternData(int(vmdk.Sector), 9)...)
+			},
+			want: []vmdk.FindingKind{vmdk.FindingOrphanedData},
+		},
+		{
+			name:  "negative grain size",
+			image: ms.b,
+			corrupt: func(image []byte) []byte {
+				binary.LittleEndian.PutUint64(image[20:], uint64(0xffffffffffffff80))
+				return image
+			},
+			want: []vmdk.FindingKind{vmdk.FindingBadHeader},
+		},
+		{
+			name:  "negative grain table size",
+			image: ms.b,
+			corrupt: func(image []byte) []byte {
+				binary.LittleEndian.PutUint32(image[44:], 0xffffffff)
+				return image
+			},
+			want: []vmdk.FindingKind{vmdk.FindingBadHeader},
+		},
+		{
+			// The grain directory size overflows.
+			name:  "huge capacity",
+			image: ms.b,
+			corrupt: func(image []byte) []byte {
+				binary.LittleEndian.PutUint64(image[12:], 1<<62)
+				binary.LittleEndian.PutUint64(image[20:], 1)
+				binary.LittleEndian.PutUint32(image[44:], 1)
+				return image
+			},
+			want: []vmdk.FindingKind{vmdk.FindingBadGrainDirectory},
+		},
+		{
+			name:  "streamOptimized",
+			image: so.Bytes(),
+		},
+		{
+			name:  "bad zlib stream",
+			image: so.Bytes(),
+			corrupt: func(image []byte) []byte {
+				off := int64(entry(image, footer.GdOffset, 2)) * vmdk.Sector
+				for i := off + 20; i < off+40; i++ {
+					image[i] ^= 0xff
+				}
+				return image
+			},
+			want: []vmdk.FindingKind{vmdk.FindingBadGrain},
+		},
+		{
+			name:  "bad grain marker",
+			image: so.Bytes(),
+			corrupt: func(image []byte) []byte {
+				off := int64(entry(image, footer.GdOffset, 2)) * vmdk.Sector
+				binary.LittleEndian.PutUint64(image[off:], 0)
+				return image
+			},
+			want: []vmdk.FindingKind{vmdk.FindingBadGrain},
+		},
+		{
+			name:  "missing footer",
+			image: so.Bytes(),
+			corrupt: func(image []byte) []byte {
+				return image[:len(image)-3*int(vmdk.Sector)]
+			},
+			want: []vmdk.FindingKind{vmdk.FindingBadHeader},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image := append([]byte(nil), tt.image...)
+			if tt.corrupt != nil {
+				image = tt.corrupt(image)
+			}
+			report, err := vmdk.Verify(bytes.NewReader(image), int64(len(image)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []vmdk.FindingKind
+			for _, f := range report.Findings {
+				got = append(got, f.Kind)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Verify() findings = %v, want %v", report.Findings, tt.want)
+			}
+			if report.OK() != (len(tt.want) == 0) {
+				t.Errorf("OK() = %v", report.OK())
+			}
+		})
+	}
+
+	if _, err := vmdk.Verify(strings.NewReader(strings.Repeat("x", 1024)), 1024); !errors.Is(err, vmdk.ErrIsNotVMDK) {
+		t.Errorf("Verify() error = %v, want %v", err, vmdk.ErrIsNotVMDK)
+	}
+}
+
+func TestRedundantGrainDirectory(t *testing.T) {
+	_, data := buildSparseLayout(t)
+	var ms memFile
+	if err := vmdk.WriteMonolithicSparse(&ms, bytes.NewReader(data), int64(len(data)), "disk.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+	header, err := vmdk.ParseHeader(bytes.NewReader(ms.b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pastEOF := uint32(len(ms.b)) / uint32(vmdk.Sector)
+
+	tests := []struct {
+		name    string
+		corrupt func(image []byte)
+		// repaired is the number of grain tables RepairGrainDirectory repairs.
+		repaired int
+	}{
+		{
+			name: "grain directory entry past EOF",
+			corrupt: func(image []byte) {
+				binary.LittleEndian.PutUint32(image[header.GdOffset*vmdk.Sector:], pastEOF)
+			},
+			repaired: 1,
+		},
+		{
+			name: "grain directory entry into a grain",
+			corrupt: func(image []byte) {
+				binary.LittleEndian.PutUint32(image[header.GdOffset*vmdk.Sector:], uint32(header.OverHead))
+			},
+			repaired: 1,
+		},
+		{
+			name: "grain table entry past EOF",
+			corrupt: func(image []byte) {
+				binary.LittleEndian.PutUint32(image[entryOffset(image, header.GdOffset, 5):], pastEOF)
+			},
+			repaired: 1,
+		},
+		{
+			name: "grain directory offset past EOF",
+			corrupt: func(image []byte) {
+				binary.LittleEndian.PutUint64(image[56:], uint64(pastEOF))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &memFile{b: append([]byte(nil), ms.b...)}
+			tt.corrupt(f.b)
+
+			d, err := vmdk.Open(bytes.NewReader(f.b), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("ReadAll() content mismatch with fallback")
+			}
+
+			if d, err := vmdk.Open(bytes.NewReader(f.b), nil, vmdk.WithRedundantFallback(false)); err == nil {
+				if got, err := io.ReadAll(d); err == nil && bytes.Equal(got, data) {
+					t.Error("ReadAll() without fallback read the redundant grain directory")
+				}
+			}
+
+			n, err := vmdk.RepairGrainDirectory(f)
+			if tt.repaired == 0 {
+				// The grain directory cannot be found.
+				if err == nil {
+					t.Error("RepairGrainDirectory() error = nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.repaired {
+				t.Errorf("RepairGrainDirectory() = %d, want %d", n, tt.repaired)
+			}
+			if n, err := vmdk.RepairGrainDirectory(f); err != nil || n != 0 {
+				t.Errorf("RepairGrainDirectory() again = %d, %v, want 0", n, err)
+			}
+			if report, err := vmdk.Verify(f, f.Size()); err != nil || !report.OK() {
+				t.Errorf("Verify() after repair = %v, %v", report, err)
+			}
+
+			d, err = vmdk.Open(bytes.NewReader(f.b), nil, vmdk.WithRedundantFallback(false))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = io.ReadAll(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("ReadAll() content mismatch after repair")
+			}
+		})
+	}
+
+	image, _ := buildSparseLayout(t)
+	if _, err := vmdk.RepairGrainDirectory(&memFile{b: image}); !errors.Is(err, vmdk.ErrNoRedundantGrainDirectory) {
+		t.Errorf("RepairGrainDirectory() error = %v, want %v", err, vmdk.ErrNoRedundantGrainDirectory)
+	}
+}
+
+func TestStreamRecovery(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	_, data := buildSparseLayout(t)
+	var buf bytes.Buffer
+	if err := vmdk.WriteStreamOptimized(&buf, bytes.NewReader(data), int64(len(data)), "disk.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+	image := buf.Bytes()
+	footer, err := vmdk.ParseHeader(bytes.NewReader(image[len(image)-2*int(vmdk.Sector):]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grain5 := int(binary.LittleEndian.Uint32(image[entryOffset(image, footer.GdOffset, 5):])) * int(vmdk.Sector)
+
+	withoutGrain5 := append([]byte(nil), data...)
+	copy(withoutGrain5[5*grain:6*grain], make([]byte, grain))
+
+	tests := []struct {
+		name  string
+		image []byte
+		want  []byte
+		// damaged is whether opening without recovery fails.
+		damaged bool
+	}{
+		{
+			name:  "intact",
+			image: image,
+			want:  data,
+		},
+		{
+			name:    "missing footer",
+			image:   image[:len(image)-3*int(vmdk.Sector)],
+			want:    data,
+			damaged: true,
+		},
+		{
+			name:    "truncated grain",
+			image:   image[:grain5+100],
+			want:    withoutGrain5,
+			damaged: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := vmdk.Open(bytes.NewReader(tt.image), nil, vmdk.WithStreamRecovery(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Error("ReadAll() content mismatch")
+			}
+
+			_, err = vmdk.Open(bytes.NewReader(tt.image), nil)
+			if (err != nil) != tt.damaged {
+				t.Errorf("Open() without recovery error = %v", err)
+			}
+		})
+	}
+
+	// The grain tables are not allocated for a huge capacity in the header.
+	huge := append([]byte(nil), image[:len(image)-3*int(vmdk.Sector)]...)
+	binary.LittleEndian.PutUint64(huge[12:], 0x40<<56)
+	d, err := vmdk.Open(bytes.NewReader(huge), nil, vmdk.WithStreamRecovery(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err := d.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("ReadAt() content mismatch with a huge capacity")
+	}
+
+	// Nor is a grain table sized from a corrupted header.
+	for _, corrupt := range []struct {
+		name string
+		off  int
+		v    uint64
+	}{
+		{"grain table entries", 44, 0xffffffff},
+		{"grain size not a power of two", 20, 100},
+		{"huge grain size", 20, 1 << 40},
+	} {
+		bad := append([]byte(nil), image[:len(image)-3*int(vmdk.Sector)]...)
+		if corrupt.off == 44 {
+			binary.LittleEndian.PutUint32(bad[corrupt.off:], uint32(corrupt.v))
+		} else {
+			binary.LittleEndian.PutUint64(bad[corrupt.off:], corrupt.v)
+		}
+		if _, err := vmdk.Open(bytes.NewReader(bad), nil, vmdk.WithStreamRecovery(true)); err == nil {
+			t.Errorf("Open() with a corrupted %s succeeded", corrupt.name)
+		}
+	}
+}
+
+func TestStreamReader(t *testing.T) {
+	grain := 128 * int(vmdk.Sector)
+	// Cross a grain table boundary (512 grains) and end with a partial grain.
+	data := make([]byte, 513*grain+4*int(vmdk.Sector))
+	copy(data[grain:], patternData(grain, 1))
+	copy(data[512*grain+100:], patternData(grain, 2))
+	copy(data[len(data)-int(vmdk.Sector):], patternData(int(vmdk.Sector), 3))
+
+	var buf bytes.Buffer
+	if err := vmdk.WriteStreamOptimized(&buf, bytes.NewReader(data), int64(len(data)), "disk.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+	// Hide io.Seeker and io.ReaderAt.
+	stream := func(b []byte) io.Reader {
+		return struct{ io.Reader }{bytes.NewReader(b)}
+	}
+
+	s, err := vmdk.NewStreamReader(stream(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.DiskDescriptor.CreateType != vmdk.StreamOptimized || s.Size() != int64(len(data)) {
+		t.Errorf("NewStreamReader() descriptor = %v, size = %d", s.DiskDescriptor, s.Size())
+	}
+	got, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("ReadAll() content mismatch")
+	}
+
+	s, err = vmdk.NewStreamReader(stream(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lbas []int64
+	for {
+		lba, grainData, err := s.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The last grain is padded with zeros.
+		want := make([]byte, grain)
+		copy(want, data[lba*vmdk.Sector:])
+		if !bytes.Equal(grainData, want) {
+			t.Errorf("Next() grain at LBA %d content mismatch", lba)
+		}
+		lbas = append(lbas, lba)
+	}
+	if want := []int64{128, 512 * 128, 513 * 128}; !reflect.DeepEqual(lbas, want) {
+		t.Errorf("Next() LBAs = %v, want %v", lbas, want)
+	}
+
+	// Cut the last grain.
+	image := buf.Bytes()
+	footer, err := vmdk.ParseHeader(bytes.NewReader(image[len(image)-2*int(vmdk.Sector):]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := int(binary.LittleEndian.Uint32(image[entryOffset(image, footer.GdOffset, 513):])) * int(vmdk.Sector)
+	s, err = vmdk.NewStreamReader(stream(image[:last+100]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(s); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("ReadAll() of a truncated stream error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	// A corrupted header does not size huge buffers.
+	for _, corrupt := range []struct {
+		name string
+		off  int
+	}{
+		{"grain size", 20},
+		{"descriptor offset", 28},
+		{"descriptor size", 36},
+		{"overhead", 64},
+	} {
+		bad := append([]byte(nil), image...)
+		binary.LittleEndian.PutUint64(bad[corrupt.off:], 1<<62)
+		if _, err := vmdk.NewStreamReader(stream(bad)); err == nil {
+			t.Errorf("NewStreamReader() with a huge %s succeeded", corrupt.name)
+		}
+	}
+}
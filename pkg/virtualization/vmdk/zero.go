@@ -0,0 +1,34 @@
+package vmdk
+
+import (
+	"io"
+)
+
+var (
+	_ sectionReaderInterface = &ZeroImage{}
+)
+
+// ZeroImage reads a ZERO extent, which has no backing file and reads as zeros.
+type ZeroImage struct {
+	VMDK
+}
+
+func NewZeroImage(v VMDK) (*ZeroImage, error) {
+	return &ZeroImage{VMDK: v}, nil
+}
+
+func (v *ZeroImage) ReadAt(p []byte, off int64) (int, error) {
+	totalSize := v.Size()
+	if off >= totalSize {
+		return 0, io.EOF
+	}
+	var err error
+	if int64(len(p)) > totalSize-off {
+		p = p[:totalSize-off]
+		err = io.EOF
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), err
+}